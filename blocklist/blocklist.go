@@ -0,0 +1,209 @@
+package blocklist
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigboofer/database"
+)
+
+// Import loads the blocklist file at the given path into the global blocklist,
+// replacing everything previously imported from a file with the same name.
+// Returns the number of users imported.
+func Import(path string) (int, error) {
+	return importSource(path, filepath.Base(path))
+}
+
+// importSource loads the blocklist file at the given path into the global
+// blocklist, replacing everything previously imported from the given source.
+// Returns the number of users imported.
+func importSource(path string, source string) (int, error) {
+	entries, err := ParseFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	database.ImportBlocklist(source, entries)
+	log.Printf("Imported %v users into the blocklist from %v\n", len(entries), path)
+	return len(entries), nil
+}
+
+// ParseFile reads the known spammers in a blocklist file. The format is
+// guessed from its extension: .csv files have a user ID (and optionally a
+// reason) per row, .json files have a list of user IDs or of objects with a
+// user ID (and optionally a reason), and anything else has a user ID per line.
+func ParseFile(path string) ([]database.BlocklistEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return parseCSV(file)
+	case ".json":
+		return parseJSON(file)
+	default:
+		return parsePlaintext(file)
+	}
+}
+
+// parseCSV reads a user ID (and optionally a reason) from each row.
+// Rows that don't start with a user ID (e.g. a header) are skipped.
+func parseCSV(reader io.Reader) ([]database.BlocklistEntry, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.Comment = '#'
+
+	var entries []database.BlocklistEntry
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		userID, err := strconv.Atoi(strings.TrimSpace(record[0]))
+		if err != nil || userID <= 0 {
+			continue
+		}
+
+		entry := database.BlocklistEntry{UserID: userID}
+		if len(record) > 1 {
+			entry.Reason = strings.TrimSpace(record[1])
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// parseJSON reads a list of user IDs, or of objects with a user ID
+// ("user_id", "userId" or "id") and optionally a "reason".
+func parseJSON(reader io.Reader) ([]database.BlocklistEntry, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []int
+	if json.Unmarshal(data, &userIDs) == nil {
+		var entries []database.BlocklistEntry
+		for _, userID := range userIDs {
+			entries = append(entries, database.BlocklistEntry{UserID: userID})
+		}
+		return entries, nil
+	}
+
+	var objects []struct {
+		UserID      int    `json:"user_id"`
+		CamelUserID int    `json:"userId"`
+		ID          int    `json:"id"`
+		Reason      string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, fmt.Errorf("expected a list of user IDs or objects: %v", err)
+	}
+
+	var entries []database.BlocklistEntry
+	for _, object := range objects {
+		userID := object.UserID
+		if userID == 0 {
+			userID = object.CamelUserID
+		}
+		if userID == 0 {
+			userID = object.ID
+		}
+		if userID <= 0 {
+			continue
+		}
+
+		entries = append(entries, database.BlocklistEntry{UserID: userID, Reason: object.Reason})
+	}
+	return entries, nil
+}
+
+// parsePlaintext reads a user ID from each line. Blank lines,
+// comments (starting with #) and anything after the ID are ignored.
+func parsePlaintext(reader io.Reader) ([]database.BlocklistEntry, error) {
+	var entries []database.BlocklistEntry
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		userID, err := strconv.Atoi(fields[0])
+		if err != nil || userID <= 0 {
+			continue
+		}
+		entries = append(entries, database.BlocklistEntry{UserID: userID})
+	}
+
+	return entries, scanner.Err()
+}
+
+// Watcher keeps the global blocklist in sync with the blocklist files in a directory.
+type Watcher struct {
+	Dir      string
+	modTimes map[string]time.Time
+}
+
+// NewWatcher returns a Watcher for the given directory.
+func NewWatcher(dir string) *Watcher {
+	return &Watcher{Dir: dir, modTimes: make(map[string]time.Time)}
+}
+
+// Reload imports every file in the directory that was added or changed since
+// the last reload, and removes the users imported from files that are gone
+// (even if they were deleted while the bot wasn't running).
+func (watcher *Watcher) Reload() {
+	files, err := ioutil.ReadDir(watcher.Dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read blocklist directory %v!! %v\n", watcher.Dir, err)
+		}
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(watcher.Dir, file.Name())
+		seen[path] = true
+		if modTime, ok := watcher.modTimes[file.Name()]; ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+
+		// Imported under its path, so it can't be mistaken for a file imported by hand
+		if _, err := importSource(path, path); err != nil {
+			log.Printf("Could not import blocklist %v!! %v\n", file.Name(), err)
+			continue
+		}
+		watcher.modTimes[file.Name()] = file.ModTime()
+	}
+
+	for _, source := range database.GetBlocklistSources() {
+		if filepath.Dir(source) == filepath.Clean(watcher.Dir) && !seen[source] {
+			log.Printf("Blocklist %v was removed, removing its users\n", source)
+			database.ImportBlocklist(source, nil)
+			delete(watcher.modTimes, filepath.Base(source))
+		}
+	}
+}
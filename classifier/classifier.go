@@ -0,0 +1,101 @@
+package classifier
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// MinTrainingMessages is the number of spam messages, and of ham (non-spam)
+// messages, a group's model needs to be trained with before classifying anything.
+const MinTrainingMessages = 10
+
+// MaxTokens is the most tokens a message is classified (or trained) by.
+const MaxTokens = 200
+
+// LinkToken is the token added for messages containing a link.
+const LinkToken = "__link__"
+
+// Tokenize splits text into the distinct words a message is classified by,
+// folded with helpers.FoldConfusables (so lookalike spellings of a word count
+// as the word). Messages containing a link also get LinkToken.
+func Tokenize(text string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+
+	if helpers.ContainsURL(text) {
+		tokens = append(tokens, LinkToken)
+		seen[LinkToken] = true
+	}
+
+	for _, word := range strings.Fields(helpers.FoldConfusables(text)) {
+		length := utf8.RuneCountInString(word)
+		if length < 2 || length > 24 || seen[word] {
+			continue
+		}
+
+		seen[word] = true
+		tokens = append(tokens, word)
+		if len(tokens) == MaxTokens {
+			break
+		}
+	}
+
+	return tokens
+}
+
+// Train teaches the model of the given group that a message
+// was spam (or wasn't). Returns false if it already knew.
+func Train(group *telegram.Chat, messageID int, text string, spam bool) bool {
+	tokens := Tokenize(text)
+	if len(tokens) == 0 {
+		return false
+	}
+
+	return database.TrainSpamModel(group, messageID, tokens, spam)
+}
+
+// SpamProbability returns how likely (from 0 to 1) text sent in the given group
+// is spam, according to its model. Returns false if the model wasn't trained
+// with at least MinTrainingMessages of each kind yet.
+func SpamProbability(group *telegram.Chat, text string) (float64, bool) {
+	documents := database.GetSpamTrainingCounts(group)
+	if documents.Spam < MinTrainingMessages || documents.Ham < MinTrainingMessages {
+		return 0, false
+	}
+
+	tokens := Tokenize(text)
+	if len(tokens) == 0 {
+		return 0, false
+	}
+
+	return Probability(tokens, database.GetSpamTokenCounts(group, tokens), documents), true
+}
+
+// Probability returns how likely (from 0 to 1) a message made up of the given
+// tokens is spam, given how many spam and ham messages each token was seen in
+// and how many of each there were (naive Bayes, with add-one smoothing).
+// Tokens never seen before are ignored.
+func Probability(tokens []string, tokenCounts map[string]database.SpamCounts, documents database.SpamCounts) float64 {
+	total := float64(documents.Spam + documents.Ham)
+	logSpam := math.Log((float64(documents.Spam) + 1) / (total + 2))
+	logHam := math.Log((float64(documents.Ham) + 1) / (total + 2))
+
+	for _, token := range tokens {
+		// Words never seen in training say nothing either way
+		counts, seen := tokenCounts[token]
+		if !seen || counts.Spam+counts.Ham == 0 {
+			continue
+		}
+
+		logSpam += math.Log((float64(counts.Spam) + 1) / (float64(documents.Spam) + 2))
+		logHam += math.Log((float64(counts.Ham) + 1) / (float64(documents.Ham) + 2))
+	}
+
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
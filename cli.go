@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"bigboofer/blocklist"
+	"bigboofer/database"
+)
+
+// cliUsage describes the commands bigboofer can run instead of the bot.
+const cliUsage = `Usage:
+  bigboofer                            run the bot
+  bigboofer blocklist import <file>    add the users in a blocklist file
+                                       (CSV, JSON or one ID per line) to the
+                                       global blocklist`
+
+// runCommand runs a command given on the command line
+// (instead of the bot), and returns its exit code.
+func runCommand(args []string) int {
+	if len(args) == 3 && args[0] == "blocklist" && args[1] == "import" {
+		database.OnboardDB()
+
+		count, err := blocklist.Import(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not import %v: %v\n", args[2], err)
+			return 1
+		}
+
+		fmt.Printf("Imported %v users into the global blocklist.\n", count)
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, cliUsage)
+	return 2
+}
@@ -1,4 +1,35 @@
 package main
 
+import "time"
+
 // APIKey is used to connect to Telegram.
 const APIKey = "TODO: Please fill in your API key here."
+
+// WebhookListen is the local address to receive webhook updates on
+// (e.g. ":8443"). Leave it empty to use long polling instead.
+const WebhookListen = ""
+
+// WebhookPublicURL is the URL Telegram should deliver webhook updates to,
+// without the secret path (e.g. the address of your reverse proxy).
+// If empty, https://<WebhookListen> is used.
+const WebhookPublicURL = ""
+
+// WebhookTLSCert and WebhookTLSKey are paths to the certificate and key
+// to serve webhook updates with. Leave them empty if TLS is handled by
+// a reverse proxy.
+const WebhookTLSCert = ""
+const WebhookTLSKey = ""
+
+// WebhookSecret is appended to WebhookPublicURL. Webhook requests made to
+// any other path are rejected, so make this long and random.
+const WebhookSecret = "TODO: Please fill in a random secret here."
+
+// BlocklistDir is a directory of blocklist files (CSV, JSON or one user ID
+// per line) to keep the global blocklist in sync with. Files added, changed
+// or removed there are picked up every BlocklistReloadInterval.
+const BlocklistDir = "blocklists"
+const BlocklistReloadInterval = 5 * time.Minute
+
+// BlocklistMaintainers are the IDs of the users allowed to change the global
+// blocklist (shared by every group) with /block global and /unblock global.
+var BlocklistMaintainers = []int{}
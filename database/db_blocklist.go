@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// ManualBlocklistSource is the source of blocklist entries added by admins
+// (as opposed to imported from a file).
+const ManualBlocklistSource = "manual"
+
+// BlocklistEntry describes a known spammer.
+type BlocklistEntry struct {
+	UserID int
+	Reason string
+}
+
+// ImportBlocklist replaces every user in the global blocklist that came from
+// the given source (e.g. a file name) with the given entries. Users removed
+// from the global blocklist with UnblockUser are left out.
+func ImportBlocklist(source string, entries []BlocklistEntry) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := transaction.Exec(
+		"DELETE FROM blocklist WHERE group_id=0 AND source=?",
+		source,
+	)
+
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+
+		_, err = transaction.Exec(
+			"INSERT OR REPLACE INTO blocklist (group_id, user_id, source, reason, added_on) "+
+				"SELECT 0, ?, ?, ?, CURRENT_TIMESTAMP "+
+				"WHERE NOT EXISTS (SELECT 1 FROM blocklist_removals WHERE user_id=?)",
+			entry.UserID, source, entry.Reason, entry.UserID,
+		)
+	}
+
+	if err != nil {
+		log.Printf("Error in ImportBlocklist query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetBlocklistSources returns the sources (e.g. file names) users in the
+// global blocklist were imported from (see ImportBlocklist).
+func GetBlocklistSources() []string {
+	db := GetDB()
+	defer db.Close()
+
+	var source string
+	var sources []string
+	queryResult, err := db.Query(
+		"SELECT DISTINCT source FROM blocklist WHERE group_id=0 AND source!=?",
+		ManualBlocklistSource,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetBlocklistSources query!! Returning nothing. %v\n", err)
+		return sources
+	}
+
+	for queryResult.Next() {
+		queryResult.Scan(&source)
+		sources = append(sources, source)
+	}
+
+	queryResult.Close()
+	return sources
+}
+
+// BlockUser adds a user to the given group's blocklist,
+// or to the global blocklist if group is nil.
+func BlockUser(group *telegram.Chat, user *telegram.User, reason string, by *telegram.User) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := transaction.Exec(
+		"INSERT OR REPLACE INTO blocklist (group_id, user_id, source, reason, added_by, added_on) "+
+			"VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		blocklistGroupID(group), user.ID, ManualBlocklistSource, reason, by.ID,
+	)
+
+	// Blocking them globally again undoes their removal
+	if err == nil && group == nil {
+		_, err = transaction.Exec("DELETE FROM blocklist_removals WHERE user_id=?", user.ID)
+	}
+
+	if err != nil {
+		log.Printf("Error in BlockUser query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// UnblockUser removes a user from the given group's blocklist, or from the
+// global blocklist (whatever its source) if group is nil. Users removed from
+// the global blocklist are remembered, so blocklist files imported later
+// (see ImportBlocklist) don't add them back. by is who unblocked them.
+// Returns false if they weren't on it.
+func UnblockUser(group *telegram.Chat, user *telegram.User, by *telegram.User) bool {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	result, err := transaction.Exec(
+		"DELETE FROM blocklist WHERE group_id=? AND user_id=?",
+		blocklistGroupID(group), user.ID,
+	)
+
+	if err == nil && group == nil {
+		_, err = transaction.Exec(
+			"INSERT OR REPLACE INTO blocklist_removals (user_id, removed_by, removed_on) "+
+				"VALUES (?, ?, CURRENT_TIMESTAMP)",
+			user.ID, by.ID,
+		)
+	}
+
+	if err != nil {
+		log.Printf("Error in UnblockUser query!! Returning false. %v\n", err)
+		transaction.Rollback()
+		return false
+	}
+
+	transaction.Commit()
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0
+}
+
+// GetBlocklistReason returns the reason the user is on the given group's
+// blocklist or the global blocklist, and true if they are on either.
+func GetBlocklistReason(user *telegram.User, group *telegram.Chat) (string, bool) {
+	db := GetDB()
+	defer db.Close()
+
+	var reason string
+	err := db.QueryRow(
+		"SELECT IFNULL(reason, '') FROM blocklist WHERE user_id=? AND group_id IN (0, ?) "+
+			"ORDER BY group_id!=0 DESC LIMIT 1",
+		user.ID, group.ID,
+	).Scan(&reason)
+
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Error in GetBlocklistReason query!! Returning false. %v\n", err)
+		return "", false
+	}
+
+	return reason, true
+}
+
+// CountBlocklist returns the number of users on the given group's
+// blocklist, or on the global blocklist if group is nil.
+func CountBlocklist(group *telegram.Chat) int {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(DISTINCT user_id) FROM blocklist WHERE group_id=?",
+		blocklistGroupID(group),
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in CountBlocklist query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	return countResult
+}
+
+// blocklistGroupID returns the group ID the given group's blocklist is
+// stored under (0 for the global blocklist, if group is nil).
+func blocklistGroupID(group *telegram.Chat) int64 {
+	if group == nil {
+		return 0
+	}
+
+	return group.ID
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"log"
+	"strings"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// AllowBot adds a bot username to the given group's allowlist,
+// so members may add it without it being removed.
+func AllowBot(group *telegram.Chat, username string) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO allowed_bots (group_id, username) VALUES (?, ?)",
+		group.ID, strings.ToLower(username),
+	)
+
+	if err != nil {
+		log.Printf("Error in AllowBot query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// DisallowBot removes a bot username from the given group's allowlist.
+func DisallowBot(group *telegram.Chat, username string) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"DELETE FROM allowed_bots WHERE group_id=? AND username=?",
+		group.ID, strings.ToLower(username),
+	)
+
+	if err != nil {
+		log.Printf("Error in DisallowBot query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// BotIsAllowed returns true if the bot username is on the given group's allowlist.
+func BotIsAllowed(group *telegram.Chat, username string) bool {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	queryResult, err := db.Query(
+		"SELECT COUNT(*) FROM allowed_bots WHERE group_id=? AND username=?",
+		group.ID, strings.ToLower(username),
+	)
+
+	if err != nil {
+		log.Printf("Error in BotIsAllowed query!! Returning false. %v\n", err)
+		return false
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&countResult)
+	queryResult.Close()
+	return countResult == 1
+}
+
+// GetAllowedBots returns the bot usernames on the given group's allowlist.
+func GetAllowedBots(group *telegram.Chat) []string {
+	db := GetDB()
+	defer db.Close()
+
+	var username string
+	var usernames []string
+
+	queryResult, err := db.Query(
+		"SELECT username FROM allowed_bots WHERE group_id=? ORDER BY username",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetAllowedBots query!! Returning nothing. %v\n", err)
+		return usernames
+	}
+
+	for queryResult.Next() {
+		queryResult.Scan(&username)
+		usernames = append(usernames, username)
+	}
+
+	queryResult.Close()
+	return usernames
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"log"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// MaxPendingDepartures is the number of times a user may leave a group
+// before answering the challenge (within DepartureWindow) before they are
+// banned when they rejoin. Set to 0 to never ban for this.
+const MaxPendingDepartures = 3
+
+// DepartureWindow describes how far back departures are counted
+// towards MaxPendingDepartures
+// (in SQLite duration format, see documentation for datetime()).
+const DepartureWindow = "-1 days"
+
+// AddDeparture records that a user left the given group
+// before answering the challenge.
+func AddDeparture(user *telegram.User, group *telegram.Chat) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT INTO departures(group_id, user_id, left_on) VALUES (?, ?, CURRENT_TIMESTAMP)",
+		group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in AddDeparture query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// CountRecentDepartures returns the number of times the user left the given
+// group before answering the challenge, within DepartureWindow.
+func CountRecentDepartures(user *telegram.User, group *telegram.Chat) int {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	queryResult, err := db.Query(
+		"SELECT COUNT(*) FROM departures WHERE group_id=? AND user_id=? "+
+			"AND left_on > datetime('now', ?)",
+		group.ID, user.ID, DepartureWindow,
+	)
+
+	if err != nil {
+		log.Printf("Error in CountRecentDepartures query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&countResult)
+	queryResult.Close()
+	return countResult
+}
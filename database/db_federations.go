@@ -0,0 +1,364 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// Federation describes a set of groups sharing their bans
+// (and optionally their verifications).
+type Federation struct {
+	ID                 int64
+	Name               string
+	Token              string
+	OwnerGroupID       int64
+	ShareVerifications bool
+}
+
+// CreateFederation creates a new federation owned by the given group, and
+// moves the group into it (out of any other federation).
+// Returns the token other groups can join it with, or "" on error.
+func CreateFederation(group *telegram.Chat, name string) string {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	token := newToken()
+	result, err := transaction.Exec(
+		"INSERT INTO federations (name, token, owner_group_id, created_on) "+
+			"VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		name, token, group.ID,
+	)
+
+	var federationID int64
+	if err == nil {
+		federationID, err = result.LastInsertId()
+	}
+	if err == nil {
+		err = joinFederation(transaction, group, federationID)
+	}
+
+	if err != nil {
+		log.Printf("Error in CreateFederation query!! %v\n", err)
+		transaction.Rollback()
+		return ""
+	}
+
+	transaction.Commit()
+	return token
+}
+
+// JoinFederation moves the given group into the federation with the given
+// token (out of any other federation). Returns the federation, or nil if
+// there is no federation with that token.
+func JoinFederation(group *telegram.Chat, token string) *Federation {
+	federation := getFederation("token=?", token)
+	if federation == nil {
+		return nil
+	}
+
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	if err := joinFederation(transaction, group, federation.ID); err != nil {
+		log.Printf("Error in JoinFederation query!! %v\n", err)
+		transaction.Rollback()
+		return nil
+	}
+
+	transaction.Commit()
+	return federation
+}
+
+// LeaveFederation removes the given group from its federation.
+func LeaveFederation(group *telegram.Chat) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := transaction.Exec(
+		"DELETE FROM federation_groups WHERE group_id=?",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in LeaveFederation query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetFederation returns the federation the given group is in,
+// or nil if it isn't in one.
+func GetFederation(group *telegram.Chat) *Federation {
+	return getFederation(
+		"id=(SELECT federation_id FROM federation_groups WHERE group_id=?)",
+		group.ID,
+	)
+}
+
+// SetFederationSharesVerifications sets whether groups in the federation
+// honor users verified in the other groups in it.
+func SetFederationSharesVerifications(federation *Federation, share bool) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := transaction.Exec(
+		"UPDATE federations SET share_verifications=? WHERE id=?",
+		share, federation.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in SetFederationSharesVerifications query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetFederationGroups returns every group in the federation.
+func GetFederationGroups(federation *Federation) []telegram.Chat {
+	db := GetDB()
+	defer db.Close()
+
+	var groupID int64
+	var groups []telegram.Chat
+
+	queryResult, err := db.Query(
+		"SELECT group_id FROM federation_groups WHERE federation_id=? ORDER BY joined_on",
+		federation.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetFederationGroups query!! Returning nothing. %v\n", err)
+		return groups
+	}
+
+	for queryResult.Next() {
+		queryResult.Scan(&groupID)
+		groups = append(groups, telegram.Chat{ID: groupID})
+	}
+
+	queryResult.Close()
+	return groups
+}
+
+// CountFederationBans returns the number of users banned in the federation.
+func CountFederationBans(federation *Federation) int {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM federation_bans WHERE federation_id=?",
+		federation.ID,
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in CountFederationBans query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	return countResult
+}
+
+// GetFederationBanReason returns the reason the user was banned in the given
+// group's federation, and true if they were (false if they weren't, or the
+// group isn't in a federation).
+func GetFederationBanReason(user *telegram.User, group *telegram.Chat) (string, bool) {
+	db := GetDB()
+	defer db.Close()
+
+	var reason string
+	err := db.QueryRow(
+		"SELECT IFNULL(reason, '') FROM federation_bans WHERE user_id=? AND federation_id="+
+			"(SELECT federation_id FROM federation_groups WHERE group_id=?)",
+		user.ID, group.ID,
+	).Scan(&reason)
+
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Error in GetFederationBanReason query!! Returning false. %v\n", err)
+		return "", false
+	}
+
+	return reason, true
+}
+
+// UserVerifiedInFederationWithin returns true if the given group's federation
+// shares verifications, and the user answered the challenge (or was approved)
+// in another group of it within the given duration (or at all, if it is 0).
+func UserVerifiedInFederationWithin(user *telegram.User, group *telegram.Chat, within time.Duration) bool {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM members "+
+			"INNER JOIN federation_groups ON federation_groups.group_id=members.group_id "+
+			"INNER JOIN federations ON federations.id=federation_groups.federation_id "+
+			"WHERE federations.share_verifications=1 AND federations.id="+
+			"(SELECT federation_id FROM federation_groups WHERE group_id=?) "+
+			"AND members.group_id!=? AND user_id=? AND state=? "+
+			"AND (? = 0 OR datetime(verified_on) >= datetime('now', ?))",
+		group.ID, group.ID, user.ID, MemberVerified,
+		int64(within.Seconds()), fmt.Sprintf("-%d seconds", int64(within.Seconds())),
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in UserVerifiedInFederationWithin query!! Returning false. %v\n", err)
+		return false
+	}
+
+	return countResult > 0
+}
+
+// federateBan records a ban in the given group's federation (if it's in one),
+// and bans the user from every other group in it (unless they were already
+// banned in the federation).
+func federateBan(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User, reason string) {
+	federation := GetFederation(group)
+	if federation == nil {
+		return
+	}
+
+	var byID interface{}
+	if by != nil {
+		byID = by.ID
+	}
+
+	db := GetDB()
+	transaction, _ := db.Begin()
+
+	result, err := transaction.Exec(
+		"INSERT OR IGNORE INTO federation_bans "+
+			"(federation_id, user_id, origin_group_id, banned_by, reason, banned_on) "+
+			"VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		federation.ID, user.ID, group.ID, byID, reason,
+	)
+
+	if err != nil {
+		log.Printf("Error in federateBan query!! %v\n", err)
+		transaction.Rollback()
+		db.Close()
+		return
+	}
+
+	transaction.Commit()
+	db.Close()
+
+	// Already banned across the federation
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return
+	}
+
+	for _, federatedGroup := range GetFederationGroups(federation) {
+		if federatedGroup.ID == group.ID {
+			continue
+		}
+
+		log.Printf(
+			"Banning %v (%v) from %v, federated with %v (%v): %v\n",
+			user.Username, user.ID, federatedGroup.ID, group.Username, group.ID, reason,
+		)
+		banUser(bot, &federatedGroup, user)
+		endChallenge(user, &federatedGroup, MemberBanned, by)
+		LogModerationAction(user, &federatedGroup, ActionBan, "banned in the federation: "+reason, 0, by)
+	}
+}
+
+// unfederateBan lifts the ban of a user in the given group's federation (if
+// it's in one and they were banned in it), and unbans them from every other
+// group in it.
+func unfederateBan(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User) {
+	federation := GetFederation(group)
+	if federation == nil {
+		return
+	}
+
+	db := GetDB()
+	transaction, _ := db.Begin()
+
+	result, err := transaction.Exec(
+		"DELETE FROM federation_bans WHERE federation_id=? AND user_id=?",
+		federation.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in unfederateBan query!! %v\n", err)
+		transaction.Rollback()
+		db.Close()
+		return
+	}
+
+	transaction.Commit()
+	db.Close()
+
+	// Wasn't banned across the federation
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return
+	}
+
+	for _, federatedGroup := range GetFederationGroups(federation) {
+		if federatedGroup.ID == group.ID {
+			continue
+		}
+
+		log.Printf(
+			"Unbanning %v (%v) from %v, federated with %v (%v)\n",
+			user.Username, user.ID, federatedGroup.ID, group.Username, group.ID,
+		)
+		unbanUser(bot, &federatedGroup, user)
+		endChallenge(user, &federatedGroup, MemberUnbanned, by)
+		LogModerationAction(user, &federatedGroup, ActionUnban, "unbanned in the federation", 0, by)
+	}
+}
+
+// joinFederation moves the given group into the given federation.
+func joinFederation(transaction *sql.Tx, group *telegram.Chat, federationID int64) error {
+	_, err := transaction.Exec(
+		"INSERT OR REPLACE INTO federation_groups (group_id, federation_id, joined_on) "+
+			"VALUES (?, ?, CURRENT_TIMESTAMP)",
+		group.ID, federationID,
+	)
+
+	return err
+}
+
+// getFederation returns the federation matching the given condition
+// (and its arguments), or nil if there is none.
+func getFederation(condition string, args ...interface{}) *Federation {
+	db := GetDB()
+	defer db.Close()
+
+	var federation Federation
+	err := db.QueryRow(
+		"SELECT id, IFNULL(name, ''), token, owner_group_id, share_verifications "+
+			"FROM federations WHERE "+condition,
+		args...,
+	).Scan(
+		&federation.ID, &federation.Name, &federation.Token,
+		&federation.OwnerGroupID, &federation.ShareVerifications,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error in getFederation query!! Returning nothing. %v\n", err)
+		return nil
+	}
+
+	return &federation
+}
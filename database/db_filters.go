@@ -0,0 +1,84 @@
+package database
+
+import (
+	"log"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// Filter describes a pattern admins don't want sent in a group,
+// and what to do to whoever sends it (e.g. "delete" or "ban").
+type Filter struct {
+	ID      int
+	Pattern string
+	Action  string
+}
+
+// AddFilter adds a filter to the given group. Returns its ID (0 if it couldn't be added).
+func AddFilter(group *telegram.Chat, pattern string, action string, by *telegram.User) int {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	result, err := db.Exec(
+		"INSERT INTO filters (group_id, pattern, action, added_by, added_on) "+
+			"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, pattern, action, by.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in AddFilter query!! Returning 0. %v\n", err)
+		transaction.Rollback()
+		return 0
+	}
+
+	transaction.Commit()
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// RemoveFilter removes a filter from the given group.
+// Returns false if the group has no filter with that ID.
+func RemoveFilter(group *telegram.Chat, id int) bool {
+	db := GetDB()
+	defer db.Close()
+
+	result, err := db.Exec(
+		"DELETE FROM filters WHERE group_id=? AND id=?",
+		group.ID, id,
+	)
+
+	if err != nil {
+		log.Printf("Error in RemoveFilter query!! Returning false. %v\n", err)
+		return false
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0
+}
+
+// GetFilters returns every filter of the given group, oldest first.
+func GetFilters(group *telegram.Chat) []Filter {
+	db := GetDB()
+	defer db.Close()
+
+	var filters []Filter
+	queryResult, err := db.Query(
+		"SELECT id, pattern, action FROM filters WHERE group_id=? ORDER BY id",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetFilters query!! Returning nothing. %v\n", err)
+		return filters
+	}
+
+	for queryResult.Next() {
+		var filter Filter
+		queryResult.Scan(&filter.ID, &filter.Pattern, &filter.Action)
+		filters = append(filters, filter)
+	}
+
+	queryResult.Close()
+	return filters
+}
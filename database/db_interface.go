@@ -1,9 +1,13 @@
 package database
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"database/sql"
 
@@ -15,79 +19,184 @@ import (
 
 // DBFile points to the location of the database file to write to
 // (it will be created if it doesn't exist)
-const DBFile = "bigboofer_data.sqlite3"
+var DBFile = "bigboofer_data.sqlite3"
 
 // MaxChallengeTime describes the maximum time to wait
 // for a user to complete a challenge before removing them
 // (in SQLite duration format, see documentation for datetime()).
 const MaxChallengeTime = "+5 minutes"
 
-// AddUser adds a new user and their group to the challenged users list.
-func AddUser(user *telegram.User, group *telegram.Chat) {
+// ChallengePunishmentSetting is the group setting deciding what happens to
+// users who don't complete their challenge in time: "ban" (the default, which
+// also bans them from the rest of the group's federation) or "kick".
+const ChallengePunishmentSetting = "challenge_punishment"
+
+// sqliteTimeLayout is the format SQLite uses for CURRENT_TIMESTAMP
+// and datetime() (always in UTC).
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// Challenge describes a user who has yet to complete the challenge in a group.
+type Challenge struct {
+	UserID      int
+	Username    string
+	DisplayName string
+	Token       string
+	IssuedOn    time.Time
+	ExpiresOn   time.Time
+}
+
+// AddUser adds a new user and their group to the challenged users list,
+// and marks them as pending there.
+// Returns a random token identifying the challenge (see GetChallengeForToken).
+// Any challenge they already had there is replaced.
+func AddUser(user *telegram.User, group *telegram.Chat) string {
 	db := GetDB()
 	defer db.Close()
 	transaction, _ := db.Begin()
 
-	_, err := db.Exec(
-		"INSERT OR REPLACE INTO challenge(group_id, user_id, username, issued_on) "+
-			"VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
-		group.ID, user.ID, user.Username,
+	token := newToken()
+	_, err := transaction.Exec(
+		"DELETE FROM challenge WHERE group_id=? AND user_id=?",
+		group.ID, user.ID,
 	)
 
+	if err == nil {
+		_, err = transaction.Exec(
+			"INSERT INTO challenge(group_id, user_id, username, display_name, issued_on, expires_on, token) "+
+				"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, datetime('now', ?), ?)",
+			group.ID, user.ID, user.Username, strings.TrimSpace(user.FirstName+" "+user.LastName),
+			MaxChallengeTime, token,
+		)
+	}
+
+	if err == nil {
+		err = setMemberState(transaction, user, group, MemberPending, nil)
+	}
+
 	if err != nil {
 		log.Printf("Error in AddUser query!! %v\n", err)
 		transaction.Rollback()
-		return
+		return ""
 	}
 
 	transaction.Commit()
+	return token
+}
+
+// VetUser removes a new user and their group from the challenged users list,
+// and marks them as verified there. by is who approved them (the user
+// themselves if they answered the challenge; may be nil).
+func VetUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	endChallenge(user, group, MemberVerified, by)
 }
 
-// VetUser removes a new user and their group from the challenged users list.
-// (i.e., they passed a challenge or it timed out.)
-func VetUser(user *telegram.User, group *telegram.Chat) {
+// ExtendChallenge gives a challenged user in the given group more time
+// to complete their challenge (or less, if duration is negative).
+func ExtendChallenge(user *telegram.User, group *telegram.Chat, duration time.Duration) {
 	db := GetDB()
 	defer db.Close()
 	transaction, _ := db.Begin()
 
 	_, err := db.Exec(
-		"DELETE FROM challenge WHERE group_id=? AND user_id=?",
+		"UPDATE challenge SET expires_on=datetime(expires_on, ?) WHERE group_id=? AND user_id=?",
+		fmt.Sprintf("%+d seconds", int64(duration.Seconds())), group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in ExtendChallenge query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// ChallengeTimeout returns MaxChallengeTime as a duration.
+func ChallengeTimeout() time.Duration {
+	db := GetDB()
+	defer db.Close()
+
+	var seconds int64
+	err := db.QueryRow(
+		"SELECT CAST(strftime('%s', 'now', ?) AS INTEGER) - CAST(strftime('%s', 'now') AS INTEGER)",
+		MaxChallengeTime,
+	).Scan(&seconds)
+
+	if err != nil {
+		log.Printf("Error in ChallengeTimeout query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// MakeChallengeStrict marks the challenge of a user in the given group as
+// strict (e.g. during a lockdown, see ChallengeIsStrict), and gives them
+// the given time (from when they were challenged) to complete it.
+// Challenges that are already strict are left as is.
+func MakeChallengeStrict(user *telegram.User, group *telegram.Chat, timeout time.Duration) {
+	db := GetDB()
+	transaction, _ := db.Begin()
+
+	result, err := db.Exec(
+		"UPDATE challenge SET strict=1 WHERE group_id=? AND user_id=? AND IFNULL(strict, 0)=0",
 		group.ID, user.ID,
 	)
 
 	if err != nil {
-		log.Printf("Error in VetUser query!! %v\n", err)
+		log.Printf("Error in MakeChallengeStrict query!! %v\n", err)
 		transaction.Rollback()
+		db.Close()
 		return
 	}
 
 	transaction.Commit()
+	db.Close()
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		ExtendChallenge(user, group, timeout-ChallengeTimeout())
+	}
 }
 
-// UserWasVetted returns true if the bot is not currently
-// waiting for a challenge response from the user in the
-// given group.
-func UserWasVetted(user *telegram.User, group *telegram.Chat) bool {
+// ChallengeIsStrict returns true if the challenge of a user in the
+// given group was made strict (see MakeChallengeStrict).
+func ChallengeIsStrict(user *telegram.User, group *telegram.Chat) bool {
 	db := GetDB()
 	defer db.Close()
 
-	// If user is currently being vetted, COUNT(*) should return 1. (Else 0.)
-	// So, if the user was already vetted here, we should expect a 0.
-	var countResult int
-	queryResult, err := db.Query(
-		"SELECT COUNT(*) FROM challenge WHERE group_id=? AND user_id=?",
+	var strict bool
+	err := db.QueryRow(
+		"SELECT IFNULL(strict, 0) FROM challenge WHERE group_id=? AND user_id=?",
 		group.ID, user.ID,
+	).Scan(&strict)
+
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error in ChallengeIsStrict query!! Returning false. %v\n", err)
+	}
+
+	return strict
+}
+
+// MarkUserReminded records that a challenged user is being reminded of
+// their challenge in the given group. Returns false (and records nothing)
+// if they were already reminded within the given interval.
+func MarkUserReminded(user *telegram.User, group *telegram.Chat, interval time.Duration) bool {
+	db := GetDB()
+	defer db.Close()
+
+	result, err := db.Exec(
+		"UPDATE challenge SET reminded_on=CURRENT_TIMESTAMP WHERE group_id=? AND user_id=? "+
+			"AND (reminded_on IS NULL OR datetime(reminded_on, ?) <= datetime('now'))",
+		group.ID, user.ID, fmt.Sprintf("+%d seconds", int64(interval.Seconds())),
 	)
 
 	if err != nil {
-		log.Printf("Error in UserWasVetted query!! Returning false. %v\n", err)
+		log.Printf("Error in MarkUserReminded query!! Returning false. %v\n", err)
 		return false
 	}
 
-	queryResult.Next()
-	queryResult.Scan(&countResult)
-	queryResult.Close()
-	return countResult == 0
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0
 }
 
 // GetIDForChallengedUsername returns the ID of a username that is challenged
@@ -98,8 +207,8 @@ func GetIDForChallengedUsername(group *telegram.Chat, username string) int {
 
 	var userID int
 	queryResult, err := db.Query(
-		"SELECT user_id FROM challenge WHERE username=?",
-		username,
+		"SELECT user_id FROM challenge WHERE group_id=? AND username=?",
+		group.ID, username,
 	)
 
 	if err != nil {
@@ -113,18 +222,200 @@ func GetIDForChallengedUsername(group *telegram.Chat, username string) int {
 	return userID
 }
 
-// SetAuthChannel sets the passphrase and channel username of the channel
-// containing the passphrase for a given chat.
-func SetAuthChannel(group *telegram.Chat, channelURL string, passphrase string) {
+// User returns the challenged user.
+func (challenge *Challenge) User() *telegram.User {
+	return &telegram.User{
+		ID:        challenge.UserID,
+		Username:  challenge.Username,
+		FirstName: challenge.DisplayName,
+	}
+}
+
+// GetChallengeForToken returns the group ID and user ID (in that order) of the
+// challenge identified by the given token. Returns 0 for both if it was not found.
+func GetChallengeForToken(token string) (int64, int) {
+	db := GetDB()
+	defer db.Close()
+
+	var groupID int64
+	var userID int
+	queryResult, err := db.Query(
+		"SELECT group_id, user_id FROM challenge WHERE token=?",
+		token,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetChallengeForToken query!! Returning 0. %v\n", err)
+		return 0, 0
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&groupID, &userID)
+	queryResult.Close()
+	return groupID, userID
+}
+
+// GetChallengedGroupsForUser returns every group the user is currently being challenged in.
+func GetChallengedGroupsForUser(user *telegram.User) []telegram.Chat {
+	db := GetDB()
+	defer db.Close()
+
+	var groupID int64
+	var groups []telegram.Chat
+
+	queryResult, err := db.Query(
+		"SELECT DISTINCT group_id FROM challenge WHERE user_id=?",
+		user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetChallengedGroupsForUser query!! Returning nothing. %v\n", err)
+		return groups
+	}
+
+	for queryResult.Next() {
+		queryResult.Scan(&groupID)
+		groups = append(groups, telegram.Chat{ID: groupID})
+	}
+
+	queryResult.Close()
+	return groups
+}
+
+// challengeColumns are the columns scanned by scanChallenges.
+const challengeColumns = "user_id, username, IFNULL(display_name, ''), IFNULL(token, ''), " +
+	"datetime(issued_on), datetime(expires_on)"
+
+// GetChallengesForChat returns up to limit users currently being challenged
+// in the given group (oldest first), skipping the first offset users.
+func GetChallengesForChat(group *telegram.Chat, limit int, offset int) []Challenge {
+	db := GetDB()
+	defer db.Close()
+
+	queryResult, err := db.Query(
+		"SELECT "+challengeColumns+" FROM challenge WHERE group_id=? "+
+			"ORDER BY issued_on, id LIMIT ? OFFSET ?",
+		group.ID, limit, offset,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetChallengesForChat query!! Returning nothing. %v\n", err)
+		return nil
+	}
+
+	return scanChallenges(queryResult)
+}
+
+// GetChallengesForWelcome returns the users still being challenged in the given
+// group who were welcomed by the given message (see SetWelcomeMessage).
+func GetChallengesForWelcome(group *telegram.Chat, messageID int) []Challenge {
+	db := GetDB()
+	defer db.Close()
+
+	queryResult, err := db.Query(
+		"SELECT "+challengeColumns+" FROM challenge WHERE group_id=? AND welcome_message_id=? "+
+			"ORDER BY id",
+		group.ID, messageID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetChallengesForWelcome query!! Returning nothing. %v\n", err)
+		return nil
+	}
+
+	return scanChallenges(queryResult)
+}
+
+// SetWelcomeMessage records the ID of the message that welcomed
+// the given challenged users to the group.
+func SetWelcomeMessage(group *telegram.Chat, users []*telegram.User, messageID int) {
 	db := GetDB()
 	defer db.Close()
 	transaction, _ := db.Begin()
 
-	_, err := db.Exec(
-		"INSERT OR REPLACE INTO channels (group_id, channel_url, passphrase) VALUES (?, ?, ?)",
-		group.ID, channelURL, passphrase,
+	for _, user := range users {
+		_, err := transaction.Exec(
+			"UPDATE challenge SET welcome_message_id=? WHERE group_id=? AND user_id=?",
+			messageID, group.ID, user.ID,
+		)
+
+		if err != nil {
+			log.Printf("Error in SetWelcomeMessage query!! %v\n", err)
+			transaction.Rollback()
+			return
+		}
+	}
+
+	transaction.Commit()
+}
+
+// scanChallenges reads challenges selected with challengeColumns,
+// and closes the rows.
+func scanChallenges(queryResult *sql.Rows) []Challenge {
+	var challenges []Challenge
+
+	for queryResult.Next() {
+		var challenge Challenge
+		var issuedOn, expiresOn string
+
+		queryResult.Scan(
+			&challenge.UserID, &challenge.Username, &challenge.DisplayName,
+			&challenge.Token, &issuedOn, &expiresOn,
+		)
+		challenge.IssuedOn = parseSQLiteTime(issuedOn)
+		challenge.ExpiresOn = parseSQLiteTime(expiresOn)
+		challenges = append(challenges, challenge)
+	}
+
+	queryResult.Close()
+	return challenges
+}
+
+// CountChallengesForChat returns the number of users currently being
+// challenged in the given group.
+func CountChallengesForChat(group *telegram.Chat) int {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	queryResult, err := db.Query(
+		"SELECT COUNT(*) FROM challenge WHERE group_id=?",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in CountChallengesForChat query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&countResult)
+	queryResult.Close()
+	return countResult
+}
+
+// SetAuthChannel sets the passphrase and channel (and its URL) of the channel
+// containing the passphrase for a given chat. If fromPin is set, the passphrase
+// will be kept in sync with the channel's pinned message (see SetPinnedPassphrase).
+func SetAuthChannel(group *telegram.Chat, channel *telegram.Chat, channelURL string, passphrase string, fromPin bool) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	// Only one channel per group
+	_, err := transaction.Exec(
+		"DELETE FROM channels WHERE group_id=?",
+		group.ID,
 	)
 
+	if err == nil {
+		_, err = transaction.Exec(
+			"INSERT INTO channels (group_id, channel_url, passphrase, channel_id, channel_title, passphrase_from_pin) "+
+				"VALUES (?, ?, ?, ?, ?, ?)",
+			group.ID, channelURL, passphrase, channel.ID, channel.Title, fromPin,
+		)
+	}
+
 	if err != nil {
 		log.Printf("Error in SetAuthChannel query!! %v\n", err)
 		transaction.Rollback()
@@ -134,6 +425,101 @@ func SetAuthChannel(group *telegram.Chat, channelURL string, passphrase string)
 	transaction.Commit()
 }
 
+// SetPinnedPassphrase updates the passphrase of the given group, if it
+// reads its passphrase from its channel's pinned message.
+func SetPinnedPassphrase(group *telegram.Chat, passphrase string) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"UPDATE channels SET passphrase=? WHERE group_id=? AND passphrase_from_pin=1",
+		passphrase, group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in SetPinnedPassphrase query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetGroupsWithPinnedPassphrase returns the groups reading their
+// passphrase from the given channel's pinned message.
+func GetGroupsWithPinnedPassphrase(channel *telegram.Chat) []telegram.Chat {
+	db := GetDB()
+	defer db.Close()
+
+	var groupID int64
+	var groups []telegram.Chat
+
+	queryResult, err := db.Query(
+		"SELECT group_id FROM channels WHERE channel_id=? AND passphrase_from_pin=1",
+		channel.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetGroupsWithPinnedPassphrase query!! Returning nothing. %v\n", err)
+		return groups
+	}
+
+	for queryResult.Next() {
+		queryResult.Scan(&groupID)
+		groups = append(groups, telegram.Chat{ID: groupID})
+	}
+
+	queryResult.Close()
+	return groups
+}
+
+// UsesPinnedPassphrase returns true if the given chat reads its passphrase
+// from its auth channel's pinned message.
+func UsesPinnedPassphrase(group *telegram.Chat) bool {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	queryResult, err := db.Query(
+		"SELECT COUNT(*) FROM channels WHERE group_id=? AND passphrase_from_pin=1",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in UsesPinnedPassphrase query!! Returning false. %v\n", err)
+		return false
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&countResult)
+	queryResult.Close()
+	return countResult == 1
+}
+
+// GetAuthChannelTitle returns the title of the channel containing the
+// passphrase for a given chat, or an empty string if it is unknown.
+func GetAuthChannelTitle(group *telegram.Chat) string {
+	db := GetDB()
+	defer db.Close()
+
+	var channelTitle string
+	queryResult, err := db.Query(
+		"SELECT IFNULL(channel_title, '') FROM channels WHERE group_id=?",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetAuthChannelTitle query!! Returning empty string. %v\n", err)
+		return ""
+	}
+
+	queryResult.Next()
+	queryResult.Scan(&channelTitle)
+	queryResult.Close()
+	return channelTitle
+}
+
 // GetAuthChannel returns the channel username of the channel
 // containing the passphrase for a given chat.
 func GetAuthChannel(group *telegram.Chat) string {
@@ -237,8 +623,8 @@ func PurgeOldChallengesForChat(bot *telegram.Bot, group *telegram.Chat) {
 
 	queryResult, err := db.Query(
 		"SELECT user_id FROM challenge WHERE group_id=? "+
-			"AND datetime(issued_on, ?) < datetime('now')",
-		group.ID, MaxChallengeTime,
+			"AND datetime(expires_on) < datetime('now')",
+		group.ID,
 	)
 
 	if err != nil {
@@ -259,6 +645,7 @@ func PurgeOldChallengesForChat(bot *telegram.Bot, group *telegram.Chat) {
 	queryResult.Close()
 	db.Close()
 
+	punishment := GetGroupSetting(group, ChallengePunishmentSetting, string(ActionBan))
 	for _, userTarget := range userTargets {
 		userChat, _ := bot.ChatByID(fmt.Sprintf("%v", userTarget.User.ID))
 
@@ -281,9 +668,83 @@ func PurgeOldChallengesForChat(bot *telegram.Bot, group *telegram.Chat) {
 			)
 		}
 
-		// Expiring is the same as removing and vetting
-		bot.Ban(group, &userTarget)
-		VetUser(userTarget.User, group)
+		// Expiring is punished the same as rejecting, unless the group only kicks
+		banUser(bot, group, userTarget.User)
+		if punishment == string(ActionKick) {
+			unbanUser(bot, group, userTarget.User)
+			KickUser(userTarget.User, group, nil)
+			LogModerationAction(userTarget.User, group, ActionKick, "didn't answer the challenge", 0, nil)
+			continue
+		}
+
+		FailUser(userTarget.User, group, nil)
+		LogModerationAction(userTarget.User, group, ActionBan, "didn't answer the challenge", 0, nil)
+		federateBan(bot, group, userTarget.User, nil, "didn't answer the challenge")
+	}
+}
+
+// PunishUser removes a user who was rejected from their challenge (or
+// otherwise misbehaved) from the group, stops challenging them, and marks
+// them as banned there. If the group is in a federation, they're banned
+// from every group in it. by is who banned them (may be nil).
+func PunishUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User, reason string) {
+	banUser(bot, group, user)
+	endChallenge(user, group, MemberBanned, by)
+	federateBan(bot, group, user, by, reason)
+}
+
+// BanUserLocally bans a user from the group only (never from the rest of its
+// federation), stops challenging them, and marks them as banned there.
+// by is who banned them (may be nil).
+func BanUserLocally(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User) {
+	banUser(bot, group, user)
+	endChallenge(user, group, MemberBanned, by)
+}
+
+// PardonUser unbans a user from the group, and marks them as unbanned there
+// (so they can join again). If they were banned across the group's federation,
+// that ban is lifted too, and they're unbanned from every group in it.
+// by is who unbanned them (may be nil, e.g. if their ban expired).
+func PardonUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User) {
+	unbanUser(bot, group, user)
+	endChallenge(user, group, MemberUnbanned, by)
+	unfederateBan(bot, group, user, by)
+}
+
+// unbanUser unbans a user from the group. Unlike bot.Unban, this doesn't
+// remove them from the group if they weren't banned.
+func unbanUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	respJSON, err := bot.Raw("unbanChatMember", map[string]string{
+		"chat_id":        group.Recipient(),
+		"user_id":        user.Recipient(),
+		"only_if_banned": "true",
+	})
+
+	var resp struct {
+		Ok          bool
+		Description string
+	}
+	if err == nil && json.Unmarshal(respJSON, &resp) == nil && !resp.Ok {
+		err = fmt.Errorf("%v", resp.Description)
+	}
+
+	if err != nil {
+		log.Printf(
+			"Could not unban %v (%v) from %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+	}
+}
+
+// banUser bans a user from the group.
+func banUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	err := bot.Ban(group, &telegram.ChatMember{User: user})
+
+	if err != nil {
+		log.Printf(
+			"Could not ban %v (%v) from %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
 	}
 }
 
@@ -301,6 +762,15 @@ func OnboardDB() {
 		}
 	}
 
+	for _, statement := range Migrations {
+		_, err := db.Exec(statement)
+
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Println("Error migrating database! Error details follow:")
+			log.Panicln(err)
+		}
+	}
+
 	db.Close()
 	log.Println("Database ready!")
 }
@@ -323,6 +793,30 @@ func GetDB() *sql.DB {
 	return DB
 }
 
+// newToken returns a random token to identify a challenge (or federation) with
+// (e.g. in deep links, which only allow [A-Za-z0-9_-]).
+func newToken() string {
+	token := make([]byte, 12)
+
+	if _, err := rand.Read(token); err != nil {
+		log.Panicln(err)
+	}
+
+	return hex.EncodeToString(token)
+}
+
+// parseSQLiteTime parses a timestamp returned by SQLite. Returns the
+// zero time if it could not be parsed.
+func parseSQLiteTime(timestamp string) time.Time {
+	parsed, err := time.Parse(sqliteTimeLayout, timestamp)
+
+	if err != nil {
+		log.Printf("Could not parse timestamp %v from database!! %v\n", timestamp, err)
+	}
+
+	return parsed
+}
+
 // readDDL returns DDL in schema.sql as a list of DDL strings
 func readDDL() []string {
 	return strings.Split(Schema, ";")
@@ -0,0 +1,422 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// MemberState describes where a user is in the verification process of a group.
+type MemberState string
+
+// The states a member of a group can be in.
+const (
+	// MemberUnknown users were never seen joining the group
+	// (e.g. they were there before the bot was).
+	MemberUnknown MemberState = ""
+	// MemberPending users are being challenged.
+	MemberPending MemberState = "pending"
+	// MemberVerified users answered the challenge, or were approved by an admin.
+	MemberVerified MemberState = "verified"
+	// MemberExempt users were never challenged (e.g. they were added by an admin).
+	MemberExempt MemberState = "exempt"
+	// MemberFailed users didn't answer the challenge in time, left before
+	// answering it, or were kicked.
+	MemberFailed MemberState = "failed"
+	// MemberBanned users were banned.
+	MemberBanned MemberState = "banned"
+	// MemberQuarantined users look like they're impersonating an admin, and
+	// are kept muted until an admin approves (or rejects) them.
+	MemberQuarantined MemberState = "quarantined"
+	// MemberKicked users were removed by an admin (with /kick), and may rejoin.
+	MemberKicked MemberState = "kicked"
+	// MemberUnbanned users were banned, then unbanned by an admin (or
+	// because their ban expired).
+	MemberUnbanned MemberState = "unbanned"
+)
+
+// ShareVerificationsSetting is the group setting which, when "on", shares the
+// group's verifications with every other group that also has it on.
+const ShareVerificationsSetting = "share_verifications"
+
+// Member describes what we know about a user in a group.
+type Member struct {
+	UserID     int
+	Username   string
+	State      MemberState
+	JoinedOn   time.Time
+	VerifiedOn time.Time
+	VerifiedBy int
+	UpdatedOn  time.Time
+}
+
+// MemberEvent describes a change in a member's state.
+type MemberEvent struct {
+	State     MemberState
+	ChangedBy int
+	ChangedOn time.Time
+}
+
+// ExemptUser stops challenging a user in the given group (if they were being
+// challenged) and records that they don't need to be, because of who they are
+// or who added them. by is who exempted them (may be nil).
+func ExemptUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	endChallenge(user, group, MemberExempt, by)
+}
+
+// FailUser stops challenging a user in the given group, and records that
+// they didn't pass the challenge. by is who removed them (may be nil).
+func FailUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	endChallenge(user, group, MemberFailed, by)
+}
+
+// KickUser stops challenging a user in the given group (if they were being
+// challenged), and records that they were removed, but may rejoin.
+// by is who kicked them (may be nil).
+func KickUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	endChallenge(user, group, MemberKicked, by)
+}
+
+// QuarantineUser stops challenging a user in the given group (if they were
+// being challenged), and records that they are kept muted until an admin
+// approves them. by is who quarantined them (may be nil).
+func QuarantineUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	endChallenge(user, group, MemberQuarantined, by)
+}
+
+// ReleaseUser lets a quarantined user in the given group go. Members who were
+// verified (or exempt) there before being quarantined (e.g. for changing their
+// name) go back to that, and keep their original verification (so they aren't
+// put on probation again). Anyone else is verified (see VetUser).
+// by is who released them.
+func ReleaseUser(user *telegram.User, group *telegram.Chat, by *telegram.User) {
+	previous := stateBeforeQuarantine(user, group)
+	if previous != MemberVerified && previous != MemberExempt {
+		VetUser(user, group, by)
+		return
+	}
+
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	var verifiedOn, verifiedBy interface{}
+	err := transaction.QueryRow(
+		"SELECT verified_on, verified_by FROM members WHERE group_id=? AND user_id=?",
+		group.ID, user.ID,
+	).Scan(&verifiedOn, &verifiedBy)
+
+	if err == nil {
+		err = setMemberState(transaction, user, group, previous, by)
+	}
+
+	if err == nil {
+		_, err = transaction.Exec(
+			"UPDATE members SET verified_on=?, verified_by=? WHERE group_id=? AND user_id=?",
+			verifiedOn, verifiedBy, group.ID, user.ID,
+		)
+	}
+
+	if err != nil {
+		log.Printf("Error in ReleaseUser query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// stateBeforeQuarantine returns the state a user was in, in the given group,
+// before they were last quarantined there (MemberUnknown if they weren't in any).
+func stateBeforeQuarantine(user *telegram.User, group *telegram.Chat) MemberState {
+	db := GetDB()
+	defer db.Close()
+
+	state := MemberUnknown
+	err := db.QueryRow(
+		"SELECT state FROM member_history WHERE group_id=? AND user_id=? AND id<("+
+			"SELECT MAX(id) FROM member_history WHERE group_id=? AND user_id=? AND state=?"+
+			") ORDER BY id DESC LIMIT 1",
+		group.ID, user.ID, group.ID, user.ID, MemberQuarantined,
+	).Scan(&state)
+
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error in stateBeforeQuarantine query!! Returning nothing. %v\n", err)
+	}
+
+	return state
+}
+
+// UpdateMemberName records the current username and name of a member of the
+// given group. Returns true if either changed since they were last recorded
+// (false if they were never seen joining the group).
+func UpdateMemberName(user *telegram.User, group *telegram.Chat) bool {
+	db := GetDB()
+	defer db.Close()
+
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	result, err := db.Exec(
+		"UPDATE members SET username=?, display_name=? WHERE group_id=? AND user_id=? "+
+			"AND (IFNULL(username, '')!=? OR IFNULL(display_name, '')!=?)",
+		user.Username, displayName, group.ID, user.ID, user.Username, displayName,
+	)
+
+	if err != nil {
+		log.Printf("Error in UpdateMemberName query!! Returning false. %v\n", err)
+		return false
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0
+}
+
+// GetMemberState returns the state of a user in the given group,
+// or MemberUnknown if we never saw them join.
+func GetMemberState(user *telegram.User, group *telegram.Chat) MemberState {
+	return GetMember(user, group).State
+}
+
+// GetMember returns what we know about a user in the given group.
+// Its State is MemberUnknown if we never saw them join.
+func GetMember(user *telegram.User, group *telegram.Chat) Member {
+	db := GetDB()
+	defer db.Close()
+
+	member := Member{UserID: user.ID}
+	var joinedOn, verifiedOn, updatedOn string
+
+	err := db.QueryRow(
+		"SELECT IFNULL(username, ''), state, IFNULL(datetime(joined_on), ''), IFNULL(datetime(verified_on), ''), "+
+			"IFNULL(verified_by, 0), IFNULL(datetime(updated_on), '') "+
+			"FROM members WHERE group_id=? AND user_id=?",
+		group.ID, user.ID,
+	).Scan(&member.Username, &member.State, &joinedOn, &verifiedOn, &member.VerifiedBy, &updatedOn)
+
+	if err == sql.ErrNoRows {
+		return member
+	}
+
+	if err != nil {
+		log.Printf("Error in GetMember query!! Returning unknown member. %v\n", err)
+		return member
+	}
+
+	member.JoinedOn = parseOptionalSQLiteTime(joinedOn)
+	member.VerifiedOn = parseOptionalSQLiteTime(verifiedOn)
+	member.UpdatedOn = parseOptionalSQLiteTime(updatedOn)
+	return member
+}
+
+// UserVerifiedWithin returns true if the user is verified (or exempt) in the
+// given group, and was verified there within the given duration (or at all,
+// if it is 0).
+func UserVerifiedWithin(user *telegram.User, group *telegram.Chat, within time.Duration) bool {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM members WHERE group_id=? AND user_id=? "+
+			"AND state IN (?, ?) AND (? = 0 OR datetime(verified_on) >= datetime('now', ?))",
+		group.ID, user.ID, MemberVerified, MemberExempt,
+		int64(within.Seconds()), fmt.Sprintf("-%d seconds", int64(within.Seconds())),
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in UserVerifiedWithin query!! Returning false. %v\n", err)
+		return false
+	}
+
+	return countResult > 0
+}
+
+// UserVerifiedElsewhereWithin returns true if the user answered the challenge
+// (or was approved) within the given duration (or at all, if it is 0) in
+// another group that shares its verifications (see ShareVerificationsSetting).
+// Verifications honored from other groups (i.e. exempt users) aren't shared again.
+func UserVerifiedElsewhereWithin(user *telegram.User, group *telegram.Chat, within time.Duration) bool {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM members INNER JOIN settings ON settings.group_id=members.group_id "+
+			"WHERE members.group_id!=? AND user_id=? AND state=? "+
+			"AND settings.key=? AND settings.value='on' "+
+			"AND (? = 0 OR datetime(verified_on) >= datetime('now', ?))",
+		group.ID, user.ID, MemberVerified, ShareVerificationsSetting,
+		int64(within.Seconds()), fmt.Sprintf("-%d seconds", int64(within.Seconds())),
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in UserVerifiedElsewhereWithin query!! Returning false. %v\n", err)
+		return false
+	}
+
+	return countResult > 0
+}
+
+// GetMemberHistory returns up to limit of the latest changes
+// to a user's state in the given group (newest first).
+func GetMemberHistory(user *telegram.User, group *telegram.Chat, limit int) []MemberEvent {
+	db := GetDB()
+	defer db.Close()
+
+	var events []MemberEvent
+	queryResult, err := db.Query(
+		"SELECT state, IFNULL(changed_by, 0), datetime(changed_on) FROM member_history "+
+			"WHERE group_id=? AND user_id=? ORDER BY changed_on DESC, id DESC LIMIT ?",
+		group.ID, user.ID, limit,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetMemberHistory query!! Returning nothing. %v\n", err)
+		return events
+	}
+
+	for queryResult.Next() {
+		var event MemberEvent
+		var changedOn string
+
+		queryResult.Scan(&event.State, &event.ChangedBy, &changedOn)
+		event.ChangedOn = parseSQLiteTime(changedOn)
+		events = append(events, event)
+	}
+
+	queryResult.Close()
+	return events
+}
+
+// GetIDForMemberUsername returns the ID of a member of the given group
+// with the given username. Returns 0 if it was not found.
+func GetIDForMemberUsername(group *telegram.Chat, username string) int {
+	db := GetDB()
+	defer db.Close()
+
+	var userID int
+	err := db.QueryRow(
+		"SELECT user_id FROM members WHERE group_id=? AND username=? COLLATE NOCASE "+
+			"ORDER BY updated_on DESC LIMIT 1",
+		group.ID, username,
+	).Scan(&userID)
+
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error in GetIDForMemberUsername query!! Returning 0. %v\n", err)
+	}
+
+	return userID
+}
+
+// CountMembersByState returns the number of members
+// of the given group we know of, in each state.
+func CountMembersByState(group *telegram.Chat) map[MemberState]int {
+	db := GetDB()
+	defer db.Close()
+
+	counts := make(map[MemberState]int)
+	queryResult, err := db.Query(
+		"SELECT state, COUNT(*) FROM members WHERE group_id=? GROUP BY state",
+		group.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in CountMembersByState query!! Returning nothing. %v\n", err)
+		return counts
+	}
+
+	for queryResult.Next() {
+		var state MemberState
+		var count int
+
+		queryResult.Scan(&state, &count)
+		counts[state] = count
+	}
+
+	queryResult.Close()
+	return counts
+}
+
+// endChallenge stops challenging a user in the given group,
+// and moves them to the given state.
+func endChallenge(user *telegram.User, group *telegram.Chat, state MemberState, by *telegram.User) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := transaction.Exec(
+		"DELETE FROM challenge WHERE group_id=? AND user_id=?",
+		group.ID, user.ID,
+	)
+
+	if err == nil {
+		err = setMemberState(transaction, user, group, state, by)
+	}
+
+	if err != nil {
+		log.Printf("Error in endChallenge query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+	resolveSpamEvidence(user, group, state)
+}
+
+// setMemberState moves a user to the given state in the given group,
+// and records the change in their history. by is who made the change
+// (may be nil, e.g. if the bot did).
+func setMemberState(transaction *sql.Tx, user *telegram.User, group *telegram.Chat, state MemberState, by *telegram.User) error {
+	var byID interface{}
+	if by != nil {
+		byID = by.ID
+	}
+
+	_, err := transaction.Exec(
+		"INSERT INTO members (group_id, user_id, username, display_name, state, updated_on) "+
+			"VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP) "+
+			"ON CONFLICT (group_id, user_id) DO UPDATE SET "+
+			"username=COALESCE(NULLIF(excluded.username, ''), members.username), "+
+			"display_name=COALESCE(NULLIF(excluded.display_name, ''), members.display_name), "+
+			"state=excluded.state, updated_on=excluded.updated_on",
+		group.ID, user.ID, user.Username, strings.TrimSpace(user.FirstName+" "+user.LastName), state,
+	)
+
+	if err == nil && state == MemberPending {
+		_, err = transaction.Exec(
+			"UPDATE members SET joined_on=CURRENT_TIMESTAMP WHERE group_id=? AND user_id=?",
+			group.ID, user.ID,
+		)
+	}
+
+	if err == nil && (state == MemberVerified || state == MemberExempt) {
+		_, err = transaction.Exec(
+			"UPDATE members SET verified_on=CURRENT_TIMESTAMP, verified_by=? WHERE group_id=? AND user_id=?",
+			byID, group.ID, user.ID,
+		)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = transaction.Exec(
+		"INSERT INTO member_history (group_id, user_id, state, changed_by, changed_on) "+
+			"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, user.ID, state, byID,
+	)
+	return err
+}
+
+// parseOptionalSQLiteTime is parseSQLiteTime, but returns the zero time
+// without complaining if the timestamp is empty (i.e. it was NULL).
+func parseOptionalSQLiteTime(timestamp string) time.Time {
+	if timestamp == "" {
+		return time.Time{}
+	}
+
+	return parseSQLiteTime(timestamp)
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// ModerationAction is something an admin did to a user with a moderation command.
+type ModerationAction string
+
+// The actions recorded in the moderation log.
+const (
+	ActionBan    ModerationAction = "ban"
+	ActionUnban  ModerationAction = "unban"
+	ActionKick   ModerationAction = "kick"
+	ActionMute   ModerationAction = "mute"
+	ActionUnmute ModerationAction = "unmute"
+)
+
+// ModerationLogEntry describes an action taken on a user in a group, and when
+// it expires (the zero time if it doesn't).
+type ModerationLogEntry struct {
+	ID        int64
+	GroupID   int64
+	UserID    int
+	Action    ModerationAction
+	Reason    string
+	DoneBy    int
+	DoneOn    time.Time
+	ExpiresOn time.Time
+}
+
+// LogModerationAction records an action taken on a user in the given group,
+// which expires after the given duration (or never, if it is 0). Any ban or
+// mute of theirs that hadn't expired yet is replaced by a new one of the same
+// kind, or lifted by an unban or unmute, and won't expire anymore.
+// by is who took the action (may be nil, e.g. if the bot did).
+func LogModerationAction(user *telegram.User, group *telegram.Chat, action ModerationAction, reason string, duration time.Duration, by *telegram.User) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	var byID interface{}
+	if by != nil {
+		byID = by.ID
+	}
+
+	var expiresOn interface{}
+	if duration > 0 {
+		expiresOn = fmt.Sprintf("+%d seconds", int64(duration.Seconds()))
+	}
+
+	_, err := transaction.Exec(
+		"UPDATE moderation_log SET expired=1 WHERE group_id=? AND user_id=? AND action=? "+
+			"AND expires_on IS NOT NULL AND expired=0",
+		group.ID, user.ID, expiringAction(action),
+	)
+
+	if err == nil {
+		_, err = transaction.Exec(
+			"INSERT INTO moderation_log (group_id, user_id, action, reason, done_by, done_on, expires_on) "+
+				"VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, datetime('now', ?))",
+			group.ID, user.ID, action, reason, byID, expiresOn,
+		)
+	}
+
+	if err != nil {
+		log.Printf("Error in LogModerationAction query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// expiringAction returns the kind of action that the given one replaces
+// or lifts (e.g. ActionMute for ActionUnmute).
+func expiringAction(action ModerationAction) ModerationAction {
+	switch action {
+	case ActionUnban:
+		return ActionBan
+	case ActionUnmute:
+		return ActionMute
+	default:
+		return action
+	}
+}
+
+// GetExpiredModerationActions returns every ban and mute (in every group)
+// that has expired, but wasn't undone yet.
+func GetExpiredModerationActions() []ModerationLogEntry {
+	return queryModerationLog(
+		"GetExpiredModerationActions",
+		"WHERE expires_on IS NOT NULL AND expired=0 AND datetime(expires_on) <= datetime('now') "+
+			"ORDER BY expires_on",
+	)
+}
+
+// GetModerationLog returns the latest actions taken on users in the given
+// group (at most limit of them), latest first.
+func GetModerationLog(group *telegram.Chat, limit int) []ModerationLogEntry {
+	return queryModerationLog(
+		"GetModerationLog",
+		"WHERE group_id=? ORDER BY done_on DESC, id DESC LIMIT ?",
+		group.ID, limit,
+	)
+}
+
+// queryModerationLog returns the entries of the moderation log matching
+// the given clause (for the query with the given name).
+func queryModerationLog(name string, clause string, args ...interface{}) []ModerationLogEntry {
+	db := GetDB()
+	defer db.Close()
+
+	var entries []ModerationLogEntry
+	queryResult, err := db.Query(
+		"SELECT id, group_id, user_id, action, IFNULL(reason, ''), IFNULL(done_by, 0), "+
+			"datetime(done_on), IFNULL(datetime(expires_on), '') FROM moderation_log "+clause,
+		args...,
+	)
+
+	if err != nil {
+		log.Printf("Error in %v query!! Returning nothing. %v\n", name, err)
+		return entries
+	}
+
+	for queryResult.Next() {
+		var entry ModerationLogEntry
+		var doneOn, expiresOn string
+
+		queryResult.Scan(
+			&entry.ID, &entry.GroupID, &entry.UserID, &entry.Action,
+			&entry.Reason, &entry.DoneBy, &doneOn, &expiresOn,
+		)
+		entry.DoneOn = parseSQLiteTime(doneOn)
+		entry.ExpiresOn = parseOptionalSQLiteTime(expiresOn)
+		entries = append(entries, entry)
+	}
+
+	queryResult.Close()
+	return entries
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"log"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// ProbationMessage describes a message a member sent in a group while on
+// probation (i.e. shortly after being verified there).
+type ProbationMessage struct {
+	MessageID int
+	Content   string
+	Blocked   string
+	SentOn    time.Time
+}
+
+// LogProbationMessage records a message a member sent in the given group while
+// on probation, and why it was blocked (empty if it wasn't), unless limit
+// messages were already recorded since they were verified there.
+func LogProbationMessage(user *telegram.User, group *telegram.Chat, messageID int, content string, blocked string, limit int) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT INTO probation_messages (group_id, user_id, message_id, content, blocked, sent_on) "+
+			"SELECT ?, ?, ?, ?, ?, CURRENT_TIMESTAMP WHERE ("+
+			"SELECT COUNT(*) FROM probation_messages WHERE group_id=? AND user_id=? "+
+			"AND sent_on >= (SELECT verified_on FROM members WHERE group_id=? AND user_id=?)) < ?",
+		group.ID, user.ID, messageID, content, blocked,
+		group.ID, user.ID, group.ID, user.ID, limit,
+	)
+
+	if err != nil {
+		log.Printf("Error in LogProbationMessage query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetProbationMessages returns the messages recorded (see LogProbationMessage)
+// since the user was last verified in the given group, oldest first.
+func GetProbationMessages(user *telegram.User, group *telegram.Chat) []ProbationMessage {
+	db := GetDB()
+	defer db.Close()
+
+	var messages []ProbationMessage
+	queryResult, err := db.Query(
+		"SELECT message_id, IFNULL(content, ''), IFNULL(blocked, ''), datetime(sent_on) "+
+			"FROM probation_messages WHERE group_id=? AND user_id=? "+
+			"AND sent_on >= (SELECT verified_on FROM members WHERE group_id=? AND user_id=?) "+
+			"ORDER BY sent_on, id",
+		group.ID, user.ID, group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetProbationMessages query!! Returning nothing. %v\n", err)
+		return messages
+	}
+
+	for queryResult.Next() {
+		var message ProbationMessage
+		var sentOn string
+
+		queryResult.Scan(&message.MessageID, &message.Content, &message.Blocked, &sentOn)
+		message.SentOn = parseSQLiteTime(sentOn)
+		messages = append(messages, message)
+	}
+
+	queryResult.Close()
+	return messages
+}
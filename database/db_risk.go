@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// RiskOutcome describes what was done with a newcomer because of their risk score.
+type RiskOutcome string
+
+// The outcomes of scoring a newcomer's risk.
+const (
+	// RiskApproved users scored low enough to skip the challenge.
+	RiskApproved RiskOutcome = "approved"
+	// RiskChallenged users were challenged as usual.
+	RiskChallenged RiskOutcome = "challenged"
+	// RiskStrictChallenged users were muted and given less time to answer.
+	RiskStrictChallenged RiskOutcome = "strictly challenged"
+	// RiskBanned users scored high enough to be banned on sight.
+	RiskBanned RiskOutcome = "banned"
+)
+
+// RiskScore describes how risky a user looked when they joined a group.
+type RiskScore struct {
+	UserID   int
+	Username string
+	Score    int
+	Signals  []string
+	Outcome  RiskOutcome
+	ScoredOn time.Time
+}
+
+// RecordRiskScore records the risk score of a user who joined the given group,
+// the signals that contributed to it, and what was done with them.
+func RecordRiskScore(user *telegram.User, group *telegram.Chat, score int, signals []string, outcome RiskOutcome) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT INTO risk_scores (group_id, user_id, username, score, signals, outcome, scored_on) "+
+			"VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, user.ID, user.Username, score, strings.Join(signals, ","), outcome,
+	)
+
+	if err != nil {
+		log.Printf("Error in RecordRiskScore query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetRiskScore returns the latest risk score of a user in the given group,
+// and false if they were never scored there.
+func GetRiskScore(user *telegram.User, group *telegram.Chat) (RiskScore, bool) {
+	db := GetDB()
+	defer db.Close()
+
+	risk := RiskScore{UserID: user.ID}
+	var signals, scoredOn string
+
+	err := db.QueryRow(
+		"SELECT IFNULL(username, ''), score, IFNULL(signals, ''), outcome, datetime(scored_on) "+
+			"FROM risk_scores WHERE group_id=? AND user_id=? ORDER BY scored_on DESC, id DESC LIMIT 1",
+		group.ID, user.ID,
+	).Scan(&risk.Username, &risk.Score, &signals, &risk.Outcome, &scoredOn)
+
+	if err == sql.ErrNoRows {
+		return risk, false
+	}
+	if err != nil {
+		log.Printf("Error in GetRiskScore query!! Returning false. %v\n", err)
+		return risk, false
+	}
+
+	risk.Signals = splitRiskSignals(signals)
+	risk.ScoredOn = parseSQLiteTime(scoredOn)
+	return risk, true
+}
+
+// GetRiskScores returns the latest risk scores recorded in the given group,
+// newest first.
+func GetRiskScores(group *telegram.Chat, limit int) []RiskScore {
+	db := GetDB()
+	defer db.Close()
+
+	var scores []RiskScore
+	queryResult, err := db.Query(
+		"SELECT user_id, IFNULL(username, ''), score, IFNULL(signals, ''), outcome, datetime(scored_on) "+
+			"FROM risk_scores WHERE group_id=? ORDER BY scored_on DESC, id DESC LIMIT ?",
+		group.ID, limit,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetRiskScores query!! Returning nothing. %v\n", err)
+		return scores
+	}
+
+	for queryResult.Next() {
+		var risk RiskScore
+		var signals, scoredOn string
+
+		queryResult.Scan(&risk.UserID, &risk.Username, &risk.Score, &signals, &risk.Outcome, &scoredOn)
+		risk.Signals = splitRiskSignals(signals)
+		risk.ScoredOn = parseSQLiteTime(scoredOn)
+		scores = append(scores, risk)
+	}
+
+	queryResult.Close()
+	return scores
+}
+
+// splitRiskSignals splits the signals column of risk_scores.
+func splitRiskSignals(signals string) []string {
+	if signals == "" {
+		return nil
+	}
+
+	return strings.Split(signals, ",")
+}
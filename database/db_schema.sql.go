@@ -12,13 +12,215 @@ CREATE TABLE IF NOT EXISTS challenge (
     group_id INTEGER,
     user_id INTEGER,
     username STRING,
-    issued_on DATETIME
+    issued_on DATETIME,
+    display_name STRING,
+    token STRING,
+    reminded_on DATETIME,
+    welcome_message_id INTEGER,
+    strict BOOLEAN DEFAULT 0,
+    expires_on DATETIME
 );
 
 CREATE TABLE IF NOT EXISTS channels (
     id INTEGER PRIMARY KEY,
     group_id INTEGER,
     channel_url STRING,
-    passphrase STRING
+    passphrase STRING,
+    channel_id INTEGER,
+    channel_title STRING,
+    passphrase_from_pin BOOLEAN DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+    group_id INTEGER,
+    key STRING,
+    value STRING,
+    PRIMARY KEY (group_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS allowed_bots (
+    group_id INTEGER,
+    username STRING,
+    PRIMARY KEY (group_id, username)
+);
+
+CREATE TABLE IF NOT EXISTS members (
+    group_id INTEGER,
+    user_id INTEGER,
+    username STRING,
+    display_name STRING,
+    state STRING,
+    joined_on DATETIME,
+    verified_on DATETIME,
+    verified_by INTEGER,
+    updated_on DATETIME,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS member_history (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    state STRING,
+    changed_by INTEGER,
+    changed_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS federations (
+    id INTEGER PRIMARY KEY,
+    name STRING,
+    token STRING UNIQUE,
+    owner_group_id INTEGER,
+    share_verifications BOOLEAN DEFAULT 0,
+    created_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS federation_groups (
+    group_id INTEGER PRIMARY KEY,
+    federation_id INTEGER,
+    joined_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS federation_bans (
+    federation_id INTEGER,
+    user_id INTEGER,
+    origin_group_id INTEGER,
+    banned_by INTEGER,
+    reason STRING,
+    banned_on DATETIME,
+    PRIMARY KEY (federation_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS blocklist (
+    group_id INTEGER,
+    user_id INTEGER,
+    source STRING,
+    reason STRING,
+    added_by INTEGER,
+    added_on DATETIME,
+    PRIMARY KEY (group_id, user_id, source)
+);
+
+CREATE TABLE IF NOT EXISTS blocklist_removals (
+    user_id INTEGER PRIMARY KEY,
+    removed_by INTEGER,
+    removed_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS departures (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    left_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS risk_scores (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    username STRING,
+    score INTEGER,
+    signals STRING,
+    outcome STRING,
+    scored_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS probation_messages (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    message_id INTEGER,
+    content STRING,
+    blocked STRING,
+    sent_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS filters (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    pattern STRING,
+    action STRING,
+    added_by INTEGER,
+    added_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS spam_training (
+    group_id INTEGER,
+    message_id INTEGER,
+    spam BOOLEAN,
+    tokens STRING,
+    trained_on DATETIME,
+    PRIMARY KEY (group_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS spam_tokens (
+    group_id INTEGER,
+    token STRING,
+    spam INTEGER DEFAULT 0,
+    ham INTEGER DEFAULT 0,
+    PRIMARY KEY (group_id, token)
+);
+
+CREATE TABLE IF NOT EXISTS held_spam (
+    group_id INTEGER,
+    user_id INTEGER,
+    message_id INTEGER,
+    tokens STRING,
+    held_on DATETIME,
+    PRIMARY KEY (group_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS spam_predictions (
+    group_id INTEGER,
+    message_id INTEGER,
+    user_id INTEGER,
+    content STRING,
+    probability REAL,
+    action STRING,
+    verdict STRING,
+    predicted_on DATETIME,
+    PRIMARY KEY (group_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS warnings (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    reason STRING,
+    warned_by INTEGER,
+    warned_on DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS moderation_log (
+    id INTEGER PRIMARY KEY,
+    group_id INTEGER,
+    user_id INTEGER,
+    action STRING,
+    reason STRING,
+    done_by INTEGER,
+    done_on DATETIME,
+    expires_on DATETIME,
+    expired BOOLEAN DEFAULT 0
 )
 `
+
+// Migrations contains SQL that brings tables created by older
+// versions of Schema up to date. Every statement is run on startup,
+// and "duplicate column" errors (already migrated) are ignored.
+var Migrations = []string{
+	"ALTER TABLE challenge ADD COLUMN display_name STRING",
+	"ALTER TABLE challenge ADD COLUMN token STRING",
+	"ALTER TABLE challenge ADD COLUMN reminded_on DATETIME",
+	"ALTER TABLE challenge ADD COLUMN welcome_message_id INTEGER",
+	"ALTER TABLE challenge ADD COLUMN strict BOOLEAN DEFAULT 0",
+	"ALTER TABLE challenge ADD COLUMN expires_on DATETIME",
+	// Challenges issued before expires_on existed expire MaxChallengeTime after being issued
+	"UPDATE challenge SET expires_on=datetime(issued_on, '" + MaxChallengeTime + "') WHERE expires_on IS NULL",
+	"ALTER TABLE members ADD COLUMN display_name STRING",
+	"ALTER TABLE channels ADD COLUMN channel_id INTEGER",
+	"ALTER TABLE channels ADD COLUMN channel_title STRING",
+	"ALTER TABLE channels ADD COLUMN passphrase_from_pin BOOLEAN DEFAULT 0",
+	// Users challenged before members existed are pending
+	"INSERT OR IGNORE INTO members (group_id, user_id, username, state, joined_on, updated_on) " +
+		"SELECT group_id, user_id, username, 'pending', issued_on, CURRENT_TIMESTAMP FROM challenge",
+}
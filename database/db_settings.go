@@ -0,0 +1,51 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// GetGroupSetting returns the value of a setting for the given group,
+// or defaultValue if it was never set there.
+func GetGroupSetting(group *telegram.Chat, key string, defaultValue string) string {
+	db := GetDB()
+	defer db.Close()
+
+	var value string
+	err := db.QueryRow(
+		"SELECT value FROM settings WHERE group_id=? AND key=?",
+		group.ID, key,
+	).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return defaultValue
+	}
+	if err != nil {
+		log.Printf("Error in GetGroupSetting query!! Returning default. %v\n", err)
+		return defaultValue
+	}
+
+	return value
+}
+
+// SetGroupSetting sets the value of a setting for the given group.
+func SetGroupSetting(group *telegram.Chat, key string, value string) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO settings (group_id, key, value) VALUES (?, ?, ?)",
+		group.ID, key, value,
+	)
+
+	if err != nil {
+		log.Printf("Error in SetGroupSetting query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
@@ -0,0 +1,346 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// The actions taken on messages that looked like spam.
+const (
+	SpamDeleted = "deleted"
+	SpamFlagged = "flagged"
+)
+
+// SpamCounts counts how many spam and non-spam ("ham") messages something
+// (e.g. a word) was seen in.
+type SpamCounts struct {
+	Spam int
+	Ham  int
+}
+
+// SpamPrediction describes a message that looked like spam, what was done
+// with it, and whether an admin confirmed it was spam.
+type SpamPrediction struct {
+	MessageID   int
+	UserID      int
+	Content     string
+	Probability float64
+	Action      string
+	Verdict     string
+}
+
+// SpamStats counts what was done with messages that looked like spam
+// in a group, and how many of them admins confirmed were (or weren't) spam.
+type SpamStats struct {
+	Deleted       int
+	Flagged       int
+	ConfirmedSpam int
+	ConfirmedHam  int
+}
+
+// TrainSpamModel records that a message sent in the given group, made up of
+// the given tokens, was spam (or wasn't). A message trained the other way
+// before is untrained first. Returns false if it was already trained this way.
+func TrainSpamModel(group *telegram.Chat, messageID int, tokens []string, spam bool) bool {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	var wasSpam bool
+	var oldTokens string
+	err := transaction.QueryRow(
+		"SELECT spam, IFNULL(tokens, '') FROM spam_training WHERE group_id=? AND message_id=?",
+		group.ID, messageID,
+	).Scan(&wasSpam, &oldTokens)
+
+	trained := err == nil
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if trained && wasSpam == spam {
+		transaction.Rollback()
+		return false
+	}
+
+	if trained && err == nil {
+		err = countSpamTokens(transaction, group, strings.Fields(oldTokens), wasSpam, -1)
+		tokens = strings.Fields(oldTokens)
+	}
+
+	if err == nil {
+		_, err = transaction.Exec(
+			"INSERT OR REPLACE INTO spam_training (group_id, message_id, spam, tokens, trained_on) "+
+				"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+			group.ID, messageID, spam, strings.Join(tokens, " "),
+		)
+	}
+
+	if err == nil {
+		err = countSpamTokens(transaction, group, tokens, spam, 1)
+	}
+
+	if err != nil {
+		log.Printf("Error in TrainSpamModel query!! Returning false. %v\n", err)
+		transaction.Rollback()
+		return false
+	}
+
+	transaction.Commit()
+	return true
+}
+
+// countSpamTokens adds delta to the spam (or ham) count of every token in the given group.
+func countSpamTokens(transaction *sql.Tx, group *telegram.Chat, tokens []string, spam bool, delta int) error {
+	spamDelta, hamDelta := 0, delta
+	if spam {
+		spamDelta, hamDelta = delta, 0
+	}
+
+	for _, token := range tokens {
+		_, err := transaction.Exec(
+			"INSERT INTO spam_tokens (group_id, token, spam, ham) VALUES (?, ?, MAX(?, 0), MAX(?, 0)) "+
+				"ON CONFLICT (group_id, token) DO UPDATE SET "+
+				"spam=MAX(spam+?, 0), ham=MAX(ham+?, 0)",
+			group.ID, token, spamDelta, hamDelta, spamDelta, hamDelta,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HoldSpamEvidence keeps (the tokens of) a message deleted from a user in the
+// given group who hasn't answered the challenge yet, until we know whether
+// they're a spammer (see resolveSpamEvidence).
+func HoldSpamEvidence(user *telegram.User, group *telegram.Chat, messageID int, tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO held_spam (group_id, user_id, message_id, tokens, held_on) "+
+			"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, user.ID, messageID, strings.Join(tokens, " "),
+	)
+
+	if err != nil {
+		log.Printf("Error in HoldSpamEvidence query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// resolveSpamEvidence trains the model of the given group with the messages
+// held from a user (see HoldSpamEvidence) once their challenge is over: as spam
+// if they failed it or were banned. If they passed, they're forgotten, since
+// newcomers' messages (e.g. "hi") aren't spam.
+func resolveSpamEvidence(user *telegram.User, group *telegram.Chat, state MemberState) {
+	spam := state == MemberFailed || state == MemberBanned
+	if !spam && state != MemberVerified && state != MemberExempt {
+		return
+	}
+
+	db := GetDB()
+	queryResult, err := db.Query(
+		"SELECT message_id, IFNULL(tokens, '') FROM held_spam WHERE group_id=? AND user_id=?",
+		group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in resolveSpamEvidence query!! %v\n", err)
+		db.Close()
+		return
+	}
+
+	held := make(map[int][]string)
+	for queryResult.Next() {
+		var messageID int
+		var tokens string
+
+		queryResult.Scan(&messageID, &tokens)
+		held[messageID] = strings.Fields(tokens)
+	}
+	queryResult.Close()
+
+	if len(held) == 0 {
+		db.Close()
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM held_spam WHERE group_id=? AND user_id=?", group.ID, user.ID)
+	db.Close()
+	if err != nil {
+		log.Printf("Error in resolveSpamEvidence query!! %v\n", err)
+		return
+	}
+
+	if spam {
+		for messageID, tokens := range held {
+			TrainSpamModel(group, messageID, tokens, true)
+		}
+	}
+}
+
+// GetSpamTrainingCounts returns how many spam and ham messages the
+// model of the given group was trained with.
+func GetSpamTrainingCounts(group *telegram.Chat) SpamCounts {
+	db := GetDB()
+	defer db.Close()
+
+	var counts SpamCounts
+	err := db.QueryRow(
+		"SELECT IFNULL(SUM(spam), 0), IFNULL(SUM(NOT spam), 0) FROM spam_training WHERE group_id=?",
+		group.ID,
+	).Scan(&counts.Spam, &counts.Ham)
+
+	if err != nil {
+		log.Printf("Error in GetSpamTrainingCounts query!! Returning nothing. %v\n", err)
+	}
+
+	return counts
+}
+
+// GetSpamTokenCounts returns how many spam and ham messages each of the given
+// tokens was seen in, in the model of the given group. Tokens never seen are left out.
+func GetSpamTokenCounts(group *telegram.Chat, tokens []string) map[string]SpamCounts {
+	db := GetDB()
+	defer db.Close()
+
+	counts := make(map[string]SpamCounts)
+	if len(tokens) == 0 {
+		return counts
+	}
+
+	args := []interface{}{group.ID}
+	for _, token := range tokens {
+		args = append(args, token)
+	}
+
+	queryResult, err := db.Query(
+		"SELECT token, spam, ham FROM spam_tokens WHERE group_id=? AND token IN (?"+
+			strings.Repeat(", ?", len(tokens)-1)+")",
+		args...,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetSpamTokenCounts query!! Returning nothing. %v\n", err)
+		return counts
+	}
+
+	for queryResult.Next() {
+		var token string
+		var tokenCounts SpamCounts
+
+		queryResult.Scan(&token, &tokenCounts.Spam, &tokenCounts.Ham)
+		counts[token] = tokenCounts
+	}
+
+	queryResult.Close()
+	return counts
+}
+
+// RecordSpamPrediction records that a message sent in the given group looked
+// like spam with the given probability, and what was done with it.
+func RecordSpamPrediction(group *telegram.Chat, message *telegram.Message, content string, probability float64, action string) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO spam_predictions "+
+			"(group_id, message_id, user_id, content, probability, action, predicted_on) "+
+			"VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, message.ID, message.Sender.ID, content, probability, action,
+	)
+
+	if err != nil {
+		log.Printf("Error in RecordSpamPrediction query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetSpamPrediction returns the prediction made about a message sent in the
+// given group, and false if it didn't look like spam.
+func GetSpamPrediction(group *telegram.Chat, messageID int) (SpamPrediction, bool) {
+	db := GetDB()
+	defer db.Close()
+
+	prediction := SpamPrediction{MessageID: messageID}
+	err := db.QueryRow(
+		"SELECT user_id, IFNULL(content, ''), probability, action, IFNULL(verdict, '') "+
+			"FROM spam_predictions WHERE group_id=? AND message_id=?",
+		group.ID, messageID,
+	).Scan(&prediction.UserID, &prediction.Content, &prediction.Probability, &prediction.Action, &prediction.Verdict)
+
+	if err == sql.ErrNoRows {
+		return prediction, false
+	}
+	if err != nil {
+		log.Printf("Error in GetSpamPrediction query!! Returning false. %v\n", err)
+		return prediction, false
+	}
+
+	return prediction, true
+}
+
+// SetSpamVerdict records whether an admin confirmed that a message sent in the
+// given group which looked like spam was spam. Does nothing if it didn't look like spam.
+func SetSpamVerdict(group *telegram.Chat, messageID int, spam bool) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	verdict := "ham"
+	if spam {
+		verdict = "spam"
+	}
+
+	_, err := db.Exec(
+		"UPDATE spam_predictions SET verdict=? WHERE group_id=? AND message_id=?",
+		verdict, group.ID, messageID,
+	)
+
+	if err != nil {
+		log.Printf("Error in SetSpamVerdict query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// GetSpamStats returns what was done with messages that looked
+// like spam in the given group, and how admins judged them.
+func GetSpamStats(group *telegram.Chat) SpamStats {
+	db := GetDB()
+	defer db.Close()
+
+	var stats SpamStats
+	err := db.QueryRow(
+		"SELECT IFNULL(SUM(action=?), 0), IFNULL(SUM(action=?), 0), "+
+			"IFNULL(SUM(verdict='spam'), 0), IFNULL(SUM(verdict='ham'), 0) "+
+			"FROM spam_predictions WHERE group_id=?",
+		SpamDeleted, SpamFlagged, group.ID,
+	).Scan(&stats.Deleted, &stats.Flagged, &stats.ConfirmedSpam, &stats.ConfirmedHam)
+
+	if err != nil {
+		log.Printf("Error in GetSpamStats query!! Returning nothing. %v\n", err)
+	}
+
+	return stats
+}
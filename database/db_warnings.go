@@ -0,0 +1,117 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// Warning describes a warning a user was given in a group.
+type Warning struct {
+	ID       int
+	Reason   string
+	WarnedBy int
+	WarnedOn time.Time
+}
+
+// AddWarning records a warning given to a user in the given group.
+// by is who warned them (may be nil, e.g. if the bot did).
+func AddWarning(user *telegram.User, group *telegram.Chat, reason string, by *telegram.User) {
+	db := GetDB()
+	defer db.Close()
+	transaction, _ := db.Begin()
+
+	var byID interface{}
+	if by != nil {
+		byID = by.ID
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO warnings (group_id, user_id, reason, warned_by, warned_on) "+
+			"VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		group.ID, user.ID, reason, byID,
+	)
+
+	if err != nil {
+		log.Printf("Error in AddWarning query!! %v\n", err)
+		transaction.Rollback()
+		return
+	}
+
+	transaction.Commit()
+}
+
+// RemoveLatestWarning removes the latest warning given to a user in the
+// given group. Returns false if they have none.
+func RemoveLatestWarning(user *telegram.User, group *telegram.Chat) bool {
+	db := GetDB()
+	defer db.Close()
+
+	result, err := db.Exec(
+		"DELETE FROM warnings WHERE id=(SELECT id FROM warnings WHERE group_id=? AND user_id=? "+
+			"ORDER BY warned_on DESC, id DESC LIMIT 1)",
+		group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in RemoveLatestWarning query!! Returning false. %v\n", err)
+		return false
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0
+}
+
+// GetWarnings returns every warning given to a user in the given group, oldest first.
+func GetWarnings(user *telegram.User, group *telegram.Chat) []Warning {
+	db := GetDB()
+	defer db.Close()
+
+	var warnings []Warning
+	queryResult, err := db.Query(
+		"SELECT id, IFNULL(reason, ''), IFNULL(warned_by, 0), datetime(warned_on) FROM warnings "+
+			"WHERE group_id=? AND user_id=? ORDER BY warned_on, id",
+		group.ID, user.ID,
+	)
+
+	if err != nil {
+		log.Printf("Error in GetWarnings query!! Returning nothing. %v\n", err)
+		return warnings
+	}
+
+	for queryResult.Next() {
+		var warning Warning
+		var warnedOn string
+
+		queryResult.Scan(&warning.ID, &warning.Reason, &warning.WarnedBy, &warnedOn)
+		warning.WarnedOn = parseSQLiteTime(warnedOn)
+		warnings = append(warnings, warning)
+	}
+
+	queryResult.Close()
+	return warnings
+}
+
+// CountWarningsWithin returns the number of warnings given to a user in the
+// given group within the given duration (or at any time, if it is 0).
+func CountWarningsWithin(user *telegram.User, group *telegram.Chat, within time.Duration) int {
+	db := GetDB()
+	defer db.Close()
+
+	var countResult int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM warnings WHERE group_id=? AND user_id=? "+
+			"AND (? = 0 OR datetime(warned_on) >= datetime('now', ?))",
+		group.ID, user.ID,
+		int64(within.Seconds()), fmt.Sprintf("-%d seconds", int64(within.Seconds())),
+	).Scan(&countResult)
+
+	if err != nil {
+		log.Printf("Error in CountWarningsWithin query!! Returning 0. %v\n", err)
+		return 0
+	}
+
+	return countResult
+}
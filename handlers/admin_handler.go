@@ -3,7 +3,10 @@ package handlers
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf16"
 
 	"bigboofer/database"
 	"bigboofer/helpers"
@@ -20,10 +23,10 @@ func OnApproveCommand(bot *telegram.Bot, message *telegram.Message) {
 		message.Chat.Username, message.Chat.ID,
 	)
 
-	user := parseApproveArgs(message)
+	user, _ := parseTargetArgs(message)
 
 	// Validate metadata and contents
-	if !validateApproveCommand(bot, message) {
+	if !validateApproveCommand(bot, message, "/approve @<username>") {
 		log.Printf(
 			"%v (%v) failed validation for %v (%v)",
 			message.Sender.Username, message.Sender.ID,
@@ -32,7 +35,7 @@ func OnApproveCommand(bot *telegram.Bot, message *telegram.Message) {
 		return
 	}
 
-	database.VetUser(user, message.Chat)
+	approveUser(bot, message.Chat, user, message.Sender)
 	log.Printf(
 		"%v (%v) manually approved %v (%v) in %v (%v)",
 		message.Sender.Username, message.Sender.ID,
@@ -41,9 +44,109 @@ func OnApproveCommand(bot *telegram.Bot, message *telegram.Message) {
 	)
 	bot.Reply(
 		message, fmt.Sprintf(
-			"OK!! @%v was manually approved! ▽・ω・▽",
-			user.Username,
+			"OK!! %v was manually approved! ▽・ω・▽",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
 		),
+		telegram.ModeHTML,
+	)
+}
+
+// OnRejectCommand immediately removes the provided user, as if their challenge
+// had expired. Checks that the user who sent the command is an admin of the
+// group they sent it in.
+func OnRejectCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to manually reject in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	user, _ := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateApproveCommand(bot, message, "/reject @<username>") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	// Rejecting is punished the same as expiring (see database.ChallengePunishmentSetting)
+	punishment := database.ModerationAction(getSetting(message.Chat, database.ChallengePunishmentSetting))
+	reply := moderateUser(bot, message.Chat, user, message.Sender, punishment, 0, "rejected by an admin")
+	log.Printf(
+		"%v (%v) manually rejected %v (%v) in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		user.Username, user.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+	bot.Reply(message, reply, telegram.ModeHTML)
+}
+
+// OnExtendCommand gives the provided user more time to complete their challenge.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnExtendCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to extend a challenge in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	usage := "/extend @<username> <duration, e.g. 10m>"
+	user, args := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateApproveCommand(bot, message, usage) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	if database.GetMemberState(user, message.Chat) == database.MemberQuarantined {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"%v is quarantined, not challenged! Please /approve or /reject them instead.",
+				helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			),
+			telegram.ModeHTML,
+		)
+		return
+	}
+
+	var duration time.Duration
+	var err error
+	if len(args) == 1 {
+		duration, err = helpers.ParseDuration(args[0])
+	}
+	if len(args) != 1 || err != nil || duration <= 0 {
+		bot.Reply(
+			message,
+			fmt.Sprintf("Please send how long to extend by along with your command! (%v)", usage),
+		)
+		return
+	}
+
+	database.ExtendChallenge(user, message.Chat, duration)
+	log.Printf(
+		"%v (%v) extended the challenge for %v (%v) in %v (%v) by %v",
+		message.Sender.Username, message.Sender.ID,
+		user.Username, user.ID,
+		message.Chat.Username, message.Chat.ID,
+		duration,
+	)
+	bot.Reply(
+		message, fmt.Sprintf(
+			"OK!! %v now has %v more to answer the challenge. ▽・ω・▽",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			duration,
+		),
+		telegram.ModeHTML,
 	)
 }
 
@@ -68,49 +171,98 @@ func OnSetChannelCommand(bot *telegram.Bot, message *telegram.Message) {
 		return
 	}
 
-	database.SetAuthChannel(message.Chat, channelName, passphrase)
+	// Make sure newcomers will actually be able to find the channel
+	channel, err := resolveAuthChannel(bot, channelName)
+	if err != nil {
+		log.Printf(
+			"%v (%v) tried to set unresolvable auth channel %v for %v (%v): %v",
+			message.Sender.Username, message.Sender.ID, channelName,
+			message.Chat.Username, message.Chat.ID, err,
+		)
+		bot.Reply(message, fmt.Sprintf(
+			"I couldn't find that channel (%v). Please make sure it's public and "+
+				"the name is spelled right!", err,
+		))
+		return
+	}
+
+	// Without a passphrase, read it from the channel's pinned message instead
+	fromPin := passphrase == ""
+	if fromPin {
+		if !canReadChannel(bot, channel) {
+			bot.Reply(message, "I can't read that channel, so I can't find the passphrase "+
+				"myself! Please add me to the channel, or send the passphrase along with "+
+				"your command. (/setchannel <channel_url> <passphrase>)")
+			return
+		}
+
+		passphrase = fetchPinnedPassphrase(bot, channel, message.Chat)
+		if passphrase == "" {
+			bot.Reply(message, fmt.Sprintf(
+				"I couldn't find the passphrase in the channel's pinned message! "+
+					"Please pin a message containing a line like \"%v xyz\".",
+				getSetting(message.Chat, "pinned_passphrase_marker"),
+			))
+			return
+		}
+	}
+
+	database.SetAuthChannel(message.Chat, channel, "https://t.me/"+channel.Username, passphrase, fromPin)
 	log.Printf(
-		"%v (%v) set auth channel for %v (%v): %v",
+		"%v (%v) set auth channel for %v (%v): %v (%v), from pin: %v",
 		message.Sender.Username, message.Sender.ID,
 		message.Chat.Username, message.Chat.ID,
-		channelName,
+		channel.Username, channel.ID, fromPin,
 	)
 
-	bot.Reply(message, "You got it, dood! Channel updated! ▽・ω・▽")
+	if fromPin {
+		bot.Reply(message, fmt.Sprintf(
+			"You got it, dood! Channel updated to %v! I'll keep the passphrase in "+
+				"sync with its pinned message. ▽・ω・▽", channel.Title,
+		))
+		return
+	}
+
+	bot.Reply(message, fmt.Sprintf(
+		"You got it, dood! Channel updated to %v! ▽・ω・▽", channel.Title,
+	))
+
+	if !canReadChannel(bot, channel) {
+		bot.Reply(
+			message,
+			"Heads up: I'm not a member of that channel, so I can't read it. "+
+				"It will still work, but you'll need to keep the passphrase here "+
+				"up to date yourself.",
+		)
+	}
 }
 
 // validateSetChannelCommand returns true if all args are valid, returns false
 // and replies with a message explaining why if not
 func validateSetChannelCommand(bot *telegram.Bot, message *telegram.Message) bool {
-	// Validate message contents and metadata
-	if !message.FromGroup() {
-		bot.Reply(message, "Please send this command from the group you wish to configure.")
-		return false
-	}
-	// Validate that the sender is an admin of this chat
-	admins, _ := bot.AdminsOf(message.Chat)
-	if !helpers.ChatMemberContains(&admins, message.Sender) {
-		// This person is not an admin.
-		bot.Delete(message)
+	if !validateAdminCommand(bot, message) {
 		return false
 	}
 	// Validate that channel was sent
-	channelName, passphrase := parseSetChannelArgs(message)
+	channelName, _ := parseSetChannelArgs(message)
 
 	if channelName == "" {
 		bot.Reply(
 			message,
 			"Please send a channel name along with your command! "+
-				"(/setchannel <channel_url> <passphrase>)",
+				"(/setchannel <channel_url> [passphrase])",
 		)
 		return false
 	}
 
-	if passphrase == "" {
+	if _, err := helpers.ParseChannelURL(channelName); err != nil {
 		bot.Reply(
 			message,
-			"Please send a passphrase along with your command!"+
-				"(/setchannel <channel_url> <passphrase>)",
+			fmt.Sprintf(
+				"That channel doesn't look right (%v)! "+
+					"(/setchannel <channel_url> [passphrase])",
+				err,
+			),
 		)
 		return false
 	}
@@ -118,65 +270,187 @@ func validateSetChannelCommand(bot *telegram.Bot, message *telegram.Message) boo
 	return true
 }
 
-// validateApproveCommand returns true if all args are valid, returns false
-// and replies with a message explaining why if not
-func validateApproveCommand(bot *telegram.Bot, message *telegram.Message) bool {
+// validateApproveCommand returns true if all args are valid for a command
+// targeting a user being challenged (/approve, /reject, /extend), returns
+// false and replies with a message explaining why (and the usage) if not
+func validateApproveCommand(bot *telegram.Bot, message *telegram.Message, usage string) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+	// Validate that the message returned a username
+	user, _ := parseTargetArgs(message)
+
+	if user == nil {
+		bot.Reply(
+			message,
+			fmt.Sprintf("Please send a username along with your command! (%v)", usage),
+		)
+		return false
+	}
+	// Validate that we are waiting on this user
+	state := database.GetMemberState(user, message.Chat)
+	if user.ID == 0 || (state != database.MemberPending && state != database.MemberQuarantined) {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"%v isn't waiting to be approved here!",
+				helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			),
+			telegram.ModeHTML,
+		)
+		return false
+	}
+
+	return true
+}
+
+// validateAdminCommand returns true if the command was sent in a group
+// by an admin of that group. Replies explaining why if it was not sent
+// in a group, and deletes the command if it wasn't sent by an admin.
+func validateAdminCommand(bot *telegram.Bot, message *telegram.Message) bool {
 	// Validate message contents and metadata
 	if !message.FromGroup() {
 		bot.Reply(message, "Please send this command from the group you wish to configure.")
 		return false
 	}
 	// Validate that the sender is an admin of this chat
-	admins, _ := bot.AdminsOf(message.Chat)
-	if !helpers.ChatMemberContains(&admins, message.Sender) {
+	if !isAdmin(bot, message.Chat, message.Sender) {
 		// This person is not an admin.
 		bot.Delete(message)
 		return false
 	}
-	// Validate that the message returned a username
-	user := parseApproveArgs(message)
 
-	if user == nil {
-		bot.Reply(
-			message,
-			"Please send a username along with your command! "+
-				"(/approve @<username>)",
-		)
-		return false
+	return true
+}
+
+// resolveAuthChannel looks up the public channel with the given URL or name.
+func resolveAuthChannel(bot *telegram.Bot, channelURL string) (*telegram.Chat, error) {
+	channelName, err := helpers.ParseChannelURL(channelURL)
+	if err != nil {
+		return nil, err
 	}
 
-	return true
+	channel, err := bot.ChatByID("@" + channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	if channel.Type != telegram.ChatChannel {
+		return nil, fmt.Errorf("@%v is not a public channel", channelName)
+	}
+
+	return channel, nil
+}
+
+// canReadChannel returns true if the bot is a member of the given channel.
+func canReadChannel(bot *telegram.Bot, channel *telegram.Chat) bool {
+	member, err := bot.ChatMemberOf(channel, bot.Me)
+
+	return err == nil &&
+		member.Role != telegram.Left && member.Role != telegram.Kicked
+}
+
+// notifyAdmins sends a message (in HTML) to the admins of the group in a PM.
+// If none of them could be PMed (e.g. none of them started a chat with us),
+// the message is sent to the group instead.
+func notifyAdmins(bot *telegram.Bot, group *telegram.Chat, text string) {
+	admins, _ := bot.AdminsOf(group)
+	notified := false
+
+	for _, admin := range admins {
+		if admin.User == nil || admin.User.IsBot {
+			continue
+		}
+
+		_, err := bot.Send(admin.User, text, telegram.ModeHTML, telegram.NoPreview)
+		notified = notified || err == nil
+	}
+
+	if !notified {
+		bot.Send(group, "Admins: "+text, telegram.ModeHTML, telegram.NoPreview)
+	}
+}
+
+// groupName returns the title (or username, or ID) of a group.
+func groupName(group *telegram.Chat) string {
+	if group.Title != "" {
+		return group.Title
+	}
+	if group.Username != "" {
+		return "@" + group.Username
+	}
+
+	return fmt.Sprint(group.ID)
+}
+
+// isAdmin returns true if the user is an admin of the given group.
+func isAdmin(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) bool {
+	admins, _ := bot.AdminsOf(group)
+	return helpers.ChatMemberContains(&admins, user)
 }
 
 // parseSetChannelArgs returns the channel name and passphrase (in that order)
 // for a message relating to a /setchannel command. If one of these arguments
 // was missing from the original message, returns an empty string (in the same order).
+// (A missing passphrase means it should be read from the channel's pinned message.)
 func parseSetChannelArgs(message *telegram.Message) (string, string) {
 	args := strings.Split(message.Payload, " ")
 
-	if len(args) != 2 {
+	switch len(args) {
+	case 1:
+		return args[0], ""
+	case 2:
+		return args[0], args[1]
+	default:
 		return "", ""
 	}
-
-	return args[0], args[1]
 }
 
-// parseApproveArgs returns the user that an admin is trying to approve
-// for a message relating to a /setchannel command. If the command
-// is missing this parameter, returns nil.
-func parseApproveArgs(message *telegram.Message) *telegram.User {
-	username := message.Payload
+// parseTargetArgs returns the user that an admin is targeting with a command
+// (e.g. /approve), and the remaining arguments. The user is resolved (in order)
+// from the message being replied to, a mention, an @username or a user ID.
+// If the command is missing this parameter, returns nil. If a username could not
+// be matched with a challenged user or a known member, the returned user's ID will be 0.
+func parseTargetArgs(message *telegram.Message) (*telegram.User, []string) {
+	args := strings.Fields(message.Payload)
 
-	if username == "" {
-		return nil
+	// Replying to the user's message (or to their join message)
+	if message.ReplyTo != nil {
+		if message.ReplyTo.UserJoined != nil {
+			return message.ReplyTo.UserJoined, args
+		}
+		if message.ReplyTo.Sender != nil {
+			return message.ReplyTo.Sender, args
+		}
 	}
 
-	if strings.HasPrefix(username, "@") {
-		username = strings.ReplaceAll(username, "@", "")
+	// Mentioning a user without a username
+	for _, entity := range message.Entities {
+		if entity.Type == telegram.EntityTMention && entity.User != nil {
+			text := utf16.Encode([]rune(message.Text))
+			if entity.Offset+entity.Length > len(text) {
+				return entity.User, nil
+			}
+
+			rest := string(utf16.Decode(text[entity.Offset+entity.Length:]))
+			return entity.User, strings.Fields(rest)
+		}
 	}
 
-	return &telegram.User{
-		ID:       database.GetIDForChallengedUsername(message.Chat, username),
-		Username: username,
+	if len(args) == 0 {
+		return nil, nil
 	}
+
+	// Passing the ID directly
+	if userID, err := strconv.Atoi(args[0]); err == nil {
+		return &telegram.User{ID: userID}, args[1:]
+	}
+
+	username := strings.TrimPrefix(args[0], "@")
+	userID := database.GetIDForChallengedUsername(message.Chat, username)
+	if userID == 0 {
+		userID = database.GetIDForMemberUsername(message.Chat, username)
+	}
+
+	return &telegram.User{ID: userID, Username: username}, args[1:]
 }
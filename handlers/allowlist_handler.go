@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnAllowBotCommand adds a bot to the group's allowlist, so members may add it
+// without it being removed. Without arguments, lists the allowed bots.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnAllowBotCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to allow bot %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, message.Payload,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	username := parseBotUsername(message)
+	if username == "" {
+		allowed := database.GetAllowedBots(message.Chat)
+		if len(allowed) == 0 {
+			bot.Reply(message, "No bots are allowed here yet! (/allowbot @<bot_username>)")
+			return
+		}
+
+		bot.Reply(message, "Allowed bots: @"+strings.Join(allowed, ", @"))
+		return
+	}
+
+	database.AllowBot(message.Chat, username)
+	bot.Reply(message, fmt.Sprintf("OK!! Members may now add @%v. ▽・ω・▽", username))
+}
+
+// OnDisallowBotCommand removes a bot from the group's allowlist.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnDisallowBotCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to disallow bot %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, message.Payload,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	username := parseBotUsername(message)
+	if username == "" {
+		bot.Reply(message, "Please send a bot username along with your command! (/disallowbot @<bot_username>)")
+		return
+	}
+
+	database.DisallowBot(message.Chat, username)
+	bot.Reply(message, fmt.Sprintf("OK!! @%v will be removed if a member adds it.", username))
+}
+
+// parseBotUsername returns the bot username passed to /allowbot or /disallowbot,
+// or an empty string if there wasn't one.
+func parseBotUsername(message *telegram.Message) string {
+	args := strings.Fields(message.Payload)
+
+	if len(args) != 1 {
+		return ""
+	}
+
+	return strings.TrimPrefix(args[0], "@")
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// BlocklistMaintainers are the IDs of the users allowed to change the global
+// blocklist (shared by every group) with /block global and /unblock global.
+// Set on startup from BlocklistMaintainers in config.go.
+var BlocklistMaintainers = []int{}
+
+// OnBlockCommand adds the provided user to the group's blocklist (or the global
+// blocklist), and bans them from the group. Anyone on a blocklist is banned as
+// soon as they join. (/block [global] @<username> [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnBlockCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to block in %v (%v): %v",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID, message.Payload,
+	)
+
+	global, scoped := parseBlocklistScope(message)
+	user, args := parseTargetArgs(scoped)
+
+	// Validate metadata and contents
+	if !validateBlocklistCommand(bot, message, global, "/block [global] @<username> [reason]") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	reason := strings.Join(args, " ")
+	if reason == "" {
+		reason = "blocked by an admin"
+	}
+
+	var group *telegram.Chat
+	if !global {
+		group = message.Chat
+	}
+
+	database.BlockUser(group, user, reason, message.Sender)
+	moderateUser(bot, message.Chat, user, message.Sender, database.ActionBan, 0, reason)
+	log.Printf(
+		"%v (%v) blocked %v (%v) in %v (%v), global: %v: %v",
+		message.Sender.Username, message.Sender.ID,
+		user.Username, user.ID,
+		message.Chat.Username, message.Chat.ID,
+		global, reason,
+	)
+
+	list := "this group's blocklist"
+	if global {
+		list = "the global blocklist"
+	}
+	bot.Reply(
+		message, fmt.Sprintf(
+			"OK!! %v is on %v, and was banned.",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName), list,
+		),
+		telegram.ModeHTML,
+	)
+}
+
+// OnUnblockCommand removes the provided user from the group's blocklist
+// (or the global blocklist). (/unblock [global] @<username>)
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnUnblockCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to unblock in %v (%v): %v",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID, message.Payload,
+	)
+
+	global, scoped := parseBlocklistScope(message)
+	user, _ := parseTargetArgs(scoped)
+
+	// Validate metadata and contents
+	if !validateBlocklistCommand(bot, message, global, "/unblock [global] @<username>") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	var group *telegram.Chat
+	if !global {
+		group = message.Chat
+	}
+
+	if !database.UnblockUser(group, user, message.Sender) {
+		bot.Reply(
+			message, fmt.Sprintf(
+				"%v isn't on that blocklist!",
+				helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			),
+			telegram.ModeHTML,
+		)
+		return
+	}
+
+	log.Printf(
+		"%v (%v) unblocked %v (%v) in %v (%v), global: %v",
+		message.Sender.Username, message.Sender.ID,
+		user.Username, user.ID,
+		message.Chat.Username, message.Chat.ID,
+		global,
+	)
+	bot.Reply(
+		message, fmt.Sprintf(
+			"OK!! %v is no longer on the blocklist. (If they were banned, they still are.)",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+		),
+		telegram.ModeHTML,
+	)
+}
+
+// validateBlocklistCommand returns true if all args are valid for /block or
+// /unblock, returns false and replies with a message explaining why if not
+func validateBlocklistCommand(bot *telegram.Bot, message *telegram.Message, global bool, usage string) bool {
+	_, scoped := parseBlocklistScope(message)
+	if !validateModerationCommand(bot, scoped, usage) {
+		return false
+	}
+
+	if global && !isBlocklistMaintainer(message.Sender) {
+		bot.Reply(message, "Only the bot's maintainers can change the global blocklist!")
+		return false
+	}
+
+	return true
+}
+
+// parseBlocklistScope returns true if a /block or /unblock command targets
+// the global blocklist, and a copy of the message without the "global" argument.
+func parseBlocklistScope(message *telegram.Message) (bool, *telegram.Message) {
+	args := strings.Fields(message.Payload)
+	if len(args) == 0 || args[0] != "global" {
+		return false, message
+	}
+
+	scoped := *message
+	scoped.Payload = strings.Join(args[1:], " ")
+	return true, &scoped
+}
+
+// isBlocklistMaintainer returns true if the user may change the global blocklist.
+func isBlocklistMaintainer(user *telegram.User) bool {
+	for _, maintainer := range BlocklistMaintainers {
+		if maintainer == user.ID {
+			return true
+		}
+	}
+
+	return false
+}
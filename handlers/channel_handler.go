@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnChannelPost encompasses the OnChannelPost and OnEditedChannelPost events.
+// If a message was pinned or edited in an auth channel, the passphrase of
+// every group reading its passphrase from that channel's pinned message
+// is refreshed.
+func OnChannelPost(bot *telegram.Bot, message *telegram.Message) {
+	if message.PinnedMessage == nil && message.LastEdit == 0 {
+		// Just a regular post
+		return
+	}
+
+	if len(database.GetGroupsWithPinnedPassphrase(message.Chat)) == 0 {
+		return
+	}
+
+	pinned := fetchPinnedText(bot, message.Chat)
+	for _, group := range database.GetGroupsWithPinnedPassphrase(message.Chat) {
+		passphrase, found := helpers.ExtractPassphrase(pinned, getSetting(&group, "pinned_passphrase_marker"))
+		if !found {
+			log.Printf(
+				"Pinned message in %v (%v) changed, but no passphrase was found for %v. Keeping the old one.\n",
+				message.Chat.Username, message.Chat.ID, group.ID,
+			)
+			continue
+		}
+
+		database.SetPinnedPassphrase(&group, passphrase)
+		log.Printf(
+			"Refreshed passphrase of %v from pinned message in %v (%v)\n",
+			group.ID, message.Chat.Username, message.Chat.ID,
+		)
+	}
+}
+
+// fetchPinnedPassphrase returns the passphrase in the channel's pinned message,
+// found with the group's pinned_passphrase_marker setting, or an empty string
+// if there is no pinned message or it has no passphrase.
+func fetchPinnedPassphrase(bot *telegram.Bot, channel *telegram.Chat, group *telegram.Chat) string {
+	passphrase, _ := helpers.ExtractPassphrase(
+		fetchPinnedText(bot, channel), getSetting(group, "pinned_passphrase_marker"),
+	)
+	return passphrase
+}
+
+// fetchPinnedText returns the text (or caption) of the channel's pinned
+// message, or an empty string if there is no pinned message.
+func fetchPinnedText(bot *telegram.Bot, channel *telegram.Chat) string {
+	// telegram.Chat doesn't include the pinned message, so ask for it ourselves
+	respJSON, err := bot.Raw("getChat", map[string]string{
+		"chat_id": channel.Recipient(),
+	})
+
+	if err != nil {
+		log.Printf(
+			"Could not fetch pinned message in %v (%v)!! %v\n",
+			channel.Username, channel.ID, err,
+		)
+		return ""
+	}
+
+	var resp struct {
+		Ok     bool
+		Result struct {
+			PinnedMessage *telegram.Message `json:"pinned_message"`
+		}
+	}
+
+	if json.Unmarshal(respJSON, &resp) != nil || !resp.Ok || resp.Result.PinnedMessage == nil {
+		return ""
+	}
+
+	text := resp.Result.PinnedMessage.Text
+	if text == "" {
+		text = resp.Result.PinnedMessage.Caption
+	}
+
+	return text
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// settingKind describes what values a group setting accepts.
+type settingKind int
+
+const (
+	boolSetting settingKind = iota
+	intSetting
+	durationSetting
+	textSetting
+	punishmentSetting
+)
+
+// groupSetting describes a per-group setting admins can change with /config.
+type groupSetting struct {
+	Kind        settingKind
+	Default     string
+	Description string
+}
+
+// groupSettings lists every per-group setting, by name.
+var groupSettings = map[string]groupSetting{
+	"trust_admin_adds": {
+		boolSetting, "on",
+		"Don't challenge users added by an admin",
+	},
+	"trust_member_adds": {
+		boolSetting, "off",
+		"Don't challenge users added by a verified member",
+	},
+	"trust_returning_members": {
+		boolSetting, "on",
+		"Don't challenge members who were verified here before and rejoin",
+	},
+	"returning_member_expiry": {
+		durationSetting, "90d",
+		"How recently returning members must have been verified to skip the challenge (0 for any time)",
+	},
+	database.ChallengePunishmentSetting: {
+		punishmentSetting, "ban",
+		"What happens to newcomers who don't answer the challenge in time: ban (from the whole federation, if the group is in one) or kick",
+	},
+	"reminder_interval": {
+		durationSetting, "1m",
+		"How often newcomers whose messages are deleted before they answer the challenge are reminded of it",
+	},
+	"pinned_passphrase_marker": {
+		textSetting, "Passphrase:",
+		"What precedes the passphrase in the channel's pinned message, if it's read from there (see /setchannel)",
+	},
+	"raid_threshold": {
+		intSetting, "10",
+		"Lock the group down when this many users join within raid_window (0 to never)",
+	},
+	"raid_window": {
+		durationSetting, "1m",
+		"How close together joins must be to count towards raid_threshold",
+	},
+	"lockdown_timeout": {
+		durationSetting, "2m",
+		"How long newcomers have to answer the challenge during a lockdown",
+	},
+	"lockdown_quiet_period": {
+		durationSetting, "10m",
+		"End a lockdown once nobody has joined for this long",
+	},
+	"probation_period": {
+		durationSetting, "24h",
+		"How long members are on probation after answering the challenge (0 for no probation)",
+	},
+	"probation_block_links": {
+		boolSetting, "on",
+		"Delete links sent by members on probation",
+	},
+	"probation_block_forwards": {
+		boolSetting, "on",
+		"Delete messages forwarded by members on probation",
+	},
+	"probation_block_media": {
+		boolSetting, "off",
+		"Delete photos, videos, files, stickers and voice messages sent by members on probation",
+	},
+	"probation_block_mentions": {
+		boolSetting, "off",
+		"Delete messages mentioning someone sent by members on probation",
+	},
+	"probation_warnings": {
+		boolSetting, "off",
+		"Warn members on probation whose messages are deleted (see warn_mute_at and warn_ban_at)",
+	},
+	"probation_logged_messages": {
+		intSetting, "5",
+		"How many of their first messages on probation are kept for /member",
+	},
+	"warn_mute_at": {
+		intSetting, "3",
+		"Mute members once they have this many warnings within warn_window (0 to never)",
+	},
+	"warn_ban_at": {
+		intSetting, "5",
+		"Ban members once they have this many warnings within warn_window (0 to never)",
+	},
+	"warn_window": {
+		durationSetting, "30d",
+		"How recent warnings must be to count towards warn_mute_at and warn_ban_at (0 for any time)",
+	},
+	"warn_mute_duration": {
+		durationSetting, "1d",
+		"How long members are muted for once they reach warn_mute_at",
+	},
+	"filter_trusted_after": {
+		durationSetting, "0",
+		"Don't apply /filter to members verified longer ago than this (0 to apply it to everyone)",
+	},
+	"filter_mute_duration": {
+		durationSetting, "1h",
+		"How long members are muted for by /filter's mute action",
+	},
+	"spam_classifier": {
+		boolSetting, "on",
+		"Check messages from recent members against what admins marked as spam with /spam and /ham",
+	},
+	"spam_recent_member_period": {
+		durationSetting, "7d",
+		"How recently members must have joined for their messages to be checked for spam",
+	},
+	"spam_delete_at": {
+		intSetting, "95",
+		"Delete messages that are at least this likely (in %) to be spam (0 to never)",
+	},
+	"spam_flag_at": {
+		intSetting, "80",
+		"Tell admins about messages that are at least this likely (in %) to be spam (0 to never)",
+	},
+	"impersonation_checks": {
+		boolSetting, "on",
+		"Mute newcomers (and members who change their name) who look like an admin, until an admin approves them",
+	},
+	"risk_scoring": {
+		boolSetting, "on",
+		"Score how spammy newcomers' profiles look, and screen them accordingly",
+	},
+	"risk_approve_below": {
+		intSetting, "0",
+		"Don't challenge newcomers whose risk score is below this (0 to always challenge)",
+	},
+	"risk_strict_at": {
+		intSetting, "40",
+		"Mute newcomers whose risk score is at least this, and give them lockdown_timeout to answer (0 to never)",
+	},
+	"risk_ban_at": {
+		intSetting, "0",
+		"Ban newcomers whose risk score is at least this, without challenging them (0 to never)",
+	},
+	database.ShareVerificationsSetting: {
+		boolSetting, "off",
+		"Share verifications with other groups that have this on, and skip the challenge for users verified there",
+	},
+}
+
+// OnConfigCommand lists the group's settings, or changes one of them.
+// (/config [<setting> <value>]) Checks that the user who sent the command
+// is an admin of the group they sent it in.
+func OnConfigCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to configure %v (%v): %v",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+		message.Payload,
+	)
+
+	// Validate metadata and contents
+	if !validateConfigCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	args := strings.Fields(message.Payload)
+	if len(args) == 0 {
+		bot.Reply(message, constructSettingsList(message.Chat), telegram.ModeHTML)
+		return
+	}
+
+	value := normalizeSetting(groupSettings[args[0]].Kind, parseSettingValue(message.Payload))
+	database.SetGroupSetting(message.Chat, args[0], value)
+	log.Printf(
+		"%v (%v) set %v to %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		args[0], value,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	bot.Reply(message, fmt.Sprintf("You got it, dood! %v is now %v. ▽・ω・▽", args[0], value))
+}
+
+// validateConfigCommand returns true if all args are valid, returns false
+// and replies with a message explaining why if not
+func validateConfigCommand(bot *telegram.Bot, message *telegram.Message) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+
+	args := strings.Fields(message.Payload)
+	if len(args) == 0 {
+		return true
+	}
+
+	setting, ok := groupSettings[args[0]]
+	if !ok || len(args) < 2 || (setting.Kind != textSetting && len(args) != 2) {
+		bot.Reply(
+			message,
+			"Please send a setting and its value along with your command! "+
+				"(/config <setting> <value>, or just /config to list settings)",
+		)
+		return false
+	}
+
+	if value := parseSettingValue(message.Payload); normalizeSetting(setting.Kind, value) == "" {
+		bot.Reply(message, fmt.Sprintf(
+			"%v doesn't look like a valid value for %v! (Expected %v)",
+			value, args[0], describeKind(setting.Kind),
+		))
+		return false
+	}
+
+	return true
+}
+
+// parseSettingValue returns the value of a /config command: everything after
+// the setting's name (text settings may have spaces).
+func parseSettingValue(payload string) string {
+	args := strings.SplitN(strings.TrimSpace(payload), " ", 2)
+	if len(args) < 2 {
+		return ""
+	}
+
+	return strings.TrimSpace(args[1])
+}
+
+// constructSettingsList returns HTML listing every setting and its value in the group.
+func constructSettingsList(group *telegram.Chat) string {
+	var names []string
+	for name := range groupSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"<b>Settings</b> (change with /config &lt;setting&gt; &lt;value&gt;)"}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf(
+			"<code>%v</code>: %v\n    %v",
+			name, html.EscapeString(getSetting(group, name)),
+			html.EscapeString(groupSettings[name].Description),
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// normalizeSetting returns the canonical form of a setting value,
+// or an empty string if it isn't valid for the kind of setting.
+func normalizeSetting(kind settingKind, value string) string {
+	switch kind {
+	case boolSetting:
+		switch strings.ToLower(value) {
+		case "on", "yes", "true", "1":
+			return "on"
+		case "off", "no", "false", "0":
+			return "off"
+		}
+	case intSetting:
+		if number, err := strconv.Atoi(value); err == nil && number >= 0 {
+			return strconv.Itoa(number)
+		}
+	case durationSetting:
+		if duration, err := helpers.ParseDuration(value); err == nil && duration >= 0 {
+			return duration.String()
+		}
+	case textSetting:
+		return value
+	case punishmentSetting:
+		switch strings.ToLower(value) {
+		case string(database.ActionBan), string(database.ActionKick):
+			return strings.ToLower(value)
+		}
+	}
+
+	return ""
+}
+
+// describeKind returns a description of the values a kind of setting accepts.
+func describeKind(kind settingKind) string {
+	switch kind {
+	case boolSetting:
+		return "on or off"
+	case intSetting:
+		return "a whole number"
+	case durationSetting:
+		return "a duration, e.g. 10m or 2d"
+	case textSetting:
+		return "some text"
+	case punishmentSetting:
+		return "ban or kick"
+	}
+
+	return "something else"
+}
+
+// getSetting returns the value of a setting in the group.
+func getSetting(group *telegram.Chat, name string) string {
+	return database.GetGroupSetting(group, name, groupSettings[name].Default)
+}
+
+// settingInt returns the value of an int setting in the group.
+func settingInt(group *telegram.Chat, name string) int {
+	number, err := strconv.Atoi(getSetting(group, name))
+
+	if err != nil {
+		number, _ = strconv.Atoi(groupSettings[name].Default)
+	}
+
+	return number
+}
+
+// settingDuration returns the value of a duration setting in the group.
+func settingDuration(group *telegram.Chat, name string) time.Duration {
+	duration, err := helpers.ParseDuration(getSetting(group, name))
+
+	if err != nil {
+		duration, _ = helpers.ParseDuration(groupSettings[name].Default)
+	}
+
+	return duration
+}
+
+// settingEnabled returns true if a bool setting is on in the group.
+func settingEnabled(group *telegram.Chat, name string) bool {
+	return getSetting(group, name) == "on"
+}
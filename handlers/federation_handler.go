@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// fedUsage describes every /fed subcommand.
+const fedUsage = "/fed new <name>, /fed join <token>, /fed leave, " +
+	"/fed verifications <on|off>, or just /fed to show the group's federation"
+
+// OnFedCommand manages the federation the group is in. Groups in a federation
+// share their bans, and optionally their verifications.
+// (/fed [new <name>|join <token>|leave|verifications <on|off>])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnFedCommand(bot *telegram.Bot, message *telegram.Message) {
+	args := strings.Fields(message.Payload)
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+
+	log.Printf(
+		"%v (%v) is attempting to run /fed %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, subcommand,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateFedCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	switch subcommand {
+	case "":
+		bot.Reply(message, constructFederationInfo(message.Chat), telegram.ModeHTML)
+	case "new":
+		onFedNew(bot, message, strings.Join(args[1:], " "))
+	case "join":
+		onFedJoin(bot, message, args[1])
+	case "leave":
+		database.LeaveFederation(message.Chat)
+		log.Printf(
+			"%v (%v) took %v (%v) out of its federation",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		bot.Reply(message, "OK!! This group is no longer in a federation.")
+	case "verifications":
+		federation := database.GetFederation(message.Chat)
+		share := normalizeSetting(boolSetting, args[1]) == "on"
+		database.SetFederationSharesVerifications(federation, share)
+		log.Printf(
+			"%v (%v) set verification sharing of federation %v to %v from %v (%v)",
+			message.Sender.Username, message.Sender.ID, federation.ID, share,
+			message.Chat.Username, message.Chat.ID,
+		)
+
+		if share {
+			bot.Reply(message, "OK!! Users verified in any group of the federation won't be challenged in the others. ▽・ω・▽")
+		} else {
+			bot.Reply(message, "OK!! Verifications are no longer shared in the federation.")
+		}
+	}
+}
+
+// onFedNew creates a new federation owned by the group, and sends its join
+// token to the admin who created it (in a PM, so members can't see it).
+func onFedNew(bot *telegram.Bot, message *telegram.Message, name string) {
+	token := database.CreateFederation(message.Chat, name)
+	if token == "" {
+		bot.Reply(message, "Something went wrong creating the federation! Please try again later.")
+		return
+	}
+
+	log.Printf(
+		"%v (%v) created federation %v from %v (%v)",
+		message.Sender.Username, message.Sender.ID, name,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	instructions := fmt.Sprintf(
+		"Admins of other groups can add them to the federation \"%v\" by running "+
+			"this in their group:\n<code>/fed join %v</code>",
+		html.EscapeString(name), token,
+	)
+
+	if _, err := bot.Send(message.Sender, instructions, telegram.ModeHTML); err == nil {
+		bot.Reply(message, fmt.Sprintf(
+			"You got it, dood! Created the federation \"%v\". I sent you its join token in a PM. ▽・ω・▽", name,
+		))
+		return
+	}
+
+	bot.Reply(
+		message,
+		fmt.Sprintf(
+			"You got it, dood! Created the federation \"%v\". I couldn't PM you, so here's "+
+				"its join token (keep it to the admins!). %v", html.EscapeString(name), instructions,
+		),
+		telegram.ModeHTML,
+	)
+}
+
+// onFedJoin moves the group into the federation with the given token.
+func onFedJoin(bot *telegram.Bot, message *telegram.Message, token string) {
+	// Don't leave the token lying around for members to see
+	bot.Delete(message)
+
+	federation := database.JoinFederation(message.Chat, token)
+	if federation == nil {
+		bot.Send(message.Chat, "I don't know of a federation with that token! Please check it and try again.")
+		return
+	}
+
+	log.Printf(
+		"%v (%v) added %v (%v) to federation %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+		federation.Name, federation.ID,
+	)
+	bot.Send(message.Chat, fmt.Sprintf(
+		"You got it, dood! This group is now in the federation \"%v\". "+
+			"Bans here will apply to every group in it, and the other way around. ▽・ω・▽",
+		federation.Name,
+	))
+}
+
+// validateFedCommand returns true if all args are valid, returns false
+// and replies with a message explaining why if not
+func validateFedCommand(bot *telegram.Bot, message *telegram.Message) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+
+	args := strings.Fields(message.Payload)
+	if len(args) == 0 {
+		return true
+	}
+
+	valid := false
+	switch args[0] {
+	case "new":
+		valid = len(args) > 1
+	case "join", "verifications":
+		valid = len(args) == 2
+	case "leave":
+		valid = len(args) == 1
+	}
+
+	if !valid {
+		bot.Reply(message, fmt.Sprintf("Please send a valid subcommand along with your command! (%v)", fedUsage))
+		return false
+	}
+
+	if args[0] == "verifications" {
+		federation := database.GetFederation(message.Chat)
+		if federation == nil || federation.OwnerGroupID != message.Chat.ID {
+			bot.Reply(message, "Only admins of the group that created the federation can change this!")
+			return false
+		}
+		if normalizeSetting(boolSetting, args[1]) == "" {
+			bot.Reply(message, "Please send on or off along with your command! (/fed verifications <on|off>)")
+			return false
+		}
+	}
+
+	if args[0] == "leave" && database.GetFederation(message.Chat) == nil {
+		bot.Reply(message, "This group isn't in a federation!")
+		return false
+	}
+
+	return true
+}
+
+// constructFederationInfo returns HTML describing the federation the group is in.
+func constructFederationInfo(group *telegram.Chat) string {
+	federation := database.GetFederation(group)
+	if federation == nil {
+		return "This group isn't in a federation. (" + html.EscapeString(fedUsage) + ")"
+	}
+
+	lines := []string{
+		fmt.Sprintf("<b>Federation</b>: %v", html.EscapeString(federation.Name)),
+		fmt.Sprintf("Groups: %v", len(database.GetFederationGroups(federation))),
+		fmt.Sprintf("Banned users: %v", database.CountFederationBans(federation)),
+		fmt.Sprintf("Shares verifications: %v", federation.ShareVerifications),
+	}
+
+	if federation.OwnerGroupID == group.ID {
+		lines = append(lines, "This group created the federation.")
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// filterUsage describes every /filter subcommand.
+const filterUsage = "/filter add <regex> <delete|warn|mute|ban>, /filter list, or /filter remove <number>"
+
+// filterActions are what can be done to whoever sends a message matching a filter.
+var filterActions = []string{"delete", "warn", "mute", "ban"}
+
+// compiledFilter is a filter with its pattern compiled.
+type compiledFilter struct {
+	database.Filter
+	Regexp *regexp.Regexp
+}
+
+// filterCache keeps the compiled filters of every group (in memory), so they
+// aren't fetched and compiled for every message. A group's filters are
+// forgotten when they change.
+var filterCache = struct {
+	sync.Mutex
+	groups map[int64][]compiledFilter
+}{
+	groups: make(map[int64][]compiledFilter),
+}
+
+// OnFilterCommand adds, lists or removes the group's content filters. Messages
+// matching a filter are deleted, and whoever sent them may be warned, muted or
+// banned. (/filter add <regex> <action>|list|remove <number>)
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnFilterCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to run /filter %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, message.Payload,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateFilterCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	subcommand, pattern, action := parseFilterArgs(message.Payload)
+	switch subcommand {
+	case "add":
+		id := database.AddFilter(message.Chat, pattern, action, message.Sender)
+		if id == 0 {
+			bot.Reply(message, "Something went wrong adding the filter! Please try again later.")
+			return
+		}
+
+		forgetFilters(message.Chat)
+		log.Printf(
+			"%v (%v) added filter #%v (%v, %v) in %v (%v)",
+			message.Sender.Username, message.Sender.ID, id, pattern, action,
+			message.Chat.Username, message.Chat.ID,
+		)
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"OK!! Filter #%v added: I'll %v messages matching <code>%v</code>. ▽・ω・▽",
+				id, describeFilterAction(action), html.EscapeString(pattern),
+			),
+			telegram.ModeHTML,
+		)
+	case "remove":
+		id, _ := strconv.Atoi(pattern)
+		if !database.RemoveFilter(message.Chat, id) {
+			bot.Reply(message, fmt.Sprintf("There's no filter #%v here! (/filter list)", pattern))
+			return
+		}
+
+		forgetFilters(message.Chat)
+		log.Printf(
+			"%v (%v) removed filter #%v in %v (%v)",
+			message.Sender.Username, message.Sender.ID, id,
+			message.Chat.Username, message.Chat.ID,
+		)
+		bot.Reply(message, fmt.Sprintf("OK!! Filter #%v removed.", id))
+	default:
+		bot.Reply(message, constructFilterList(message.Chat), telegram.ModeHTML)
+	}
+}
+
+// validateFilterCommand returns true if all args are valid, returns false
+// and replies with a message explaining why if not
+func validateFilterCommand(bot *telegram.Bot, message *telegram.Message) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+
+	subcommand, pattern, action := parseFilterArgs(message.Payload)
+	switch subcommand {
+	case "", "list":
+		return true
+	case "add":
+		if pattern == "" || !isFilterAction(action) {
+			bot.Reply(message, fmt.Sprintf("Please send a pattern and an action! (%v)", filterUsage))
+			return false
+		}
+		if _, err := compileFilter(pattern); err != nil {
+			bot.Reply(message, fmt.Sprintf("That pattern doesn't look right (%v)! (%v)", err, filterUsage))
+			return false
+		}
+		return true
+	case "remove":
+		if _, err := strconv.Atoi(pattern); err != nil {
+			bot.Reply(message, fmt.Sprintf("Please send the number of the filter to remove! (%v)", filterUsage))
+			return false
+		}
+		return true
+	default:
+		bot.Reply(message, fmt.Sprintf("I don't know how to do that! (%v)", filterUsage))
+		return false
+	}
+}
+
+// parseFilterArgs returns the subcommand, pattern and action (in that order)
+// of a /filter command. The action is the last argument of /filter add, and
+// the pattern everything in between. For /filter remove, the pattern is the
+// filter's number.
+func parseFilterArgs(payload string) (string, string, string) {
+	payload = strings.TrimSpace(payload)
+	args := strings.SplitN(payload, " ", 2)
+	if len(args) < 2 {
+		return args[0], "", ""
+	}
+
+	subcommand, rest := args[0], strings.TrimSpace(args[1])
+	if subcommand != "add" {
+		return subcommand, rest, ""
+	}
+
+	split := strings.LastIndex(rest, " ")
+	if split == -1 {
+		return subcommand, rest, ""
+	}
+
+	return subcommand, strings.TrimSpace(rest[:split]), strings.ToLower(rest[split+1:])
+}
+
+// isFilterAction returns true if the action is one of filterActions.
+func isFilterAction(action string) bool {
+	for _, filterAction := range filterActions {
+		if action == filterAction {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileFilter compiles the pattern of a filter. Filters ignore case.
+func compileFilter(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// groupFilters returns the compiled filters of the group.
+func groupFilters(group *telegram.Chat) []compiledFilter {
+	filterCache.Lock()
+	defer filterCache.Unlock()
+
+	if filters, found := filterCache.groups[group.ID]; found {
+		return filters
+	}
+
+	var filters []compiledFilter
+	for _, filter := range database.GetFilters(group) {
+		compiled, err := compileFilter(filter.Pattern)
+		if err != nil {
+			log.Printf("Could not compile filter #%v (%v)!! %v\n", filter.ID, filter.Pattern, err)
+			continue
+		}
+
+		filters = append(filters, compiledFilter{filter, compiled})
+	}
+
+	filterCache.groups[group.ID] = filters
+	return filters
+}
+
+// forgetFilters removes the group's compiled filters from the cache,
+// so they are fetched again.
+func forgetFilters(group *telegram.Chat) {
+	filterCache.Lock()
+	defer filterCache.Unlock()
+
+	delete(filterCache.groups, group.ID)
+}
+
+// applyFilters deletes a message whose text or caption matches one of the
+// group's filters, and warns, mutes or bans whoever sent it according to the
+// filter's action. Admins, and members trusted according to the group's
+// filter_trusted_after setting, aren't filtered. Returns true if it was deleted.
+func applyFilters(bot *telegram.Bot, message *telegram.Message, member database.Member) bool {
+	group := message.Chat
+	text := messageText(message)
+	filters := groupFilters(group)
+	if text == "" || len(filters) == 0 || trustedByFilters(group, member) {
+		return false
+	}
+
+	admins := cachedAdminsOf(bot, group)
+	if helpers.ChatMemberContains(&admins, message.Sender) {
+		return false
+	}
+
+	for _, filter := range filters {
+		if filter.Regexp.MatchString(text) {
+			enforceFilter(bot, message, filter.Filter)
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustedByFilters returns true if the group's filters don't apply to the
+// member because they were verified longer than filter_trusted_after ago
+// (or were there before us).
+func trustedByFilters(group *telegram.Chat, member database.Member) bool {
+	trustedAfter := settingDuration(group, "filter_trusted_after")
+	if trustedAfter <= 0 {
+		return false
+	}
+
+	switch member.State {
+	case database.MemberUnknown:
+		return true
+	case database.MemberVerified, database.MemberExempt:
+		return !member.VerifiedOn.IsZero() && time.Since(member.VerifiedOn) >= trustedAfter
+	default:
+		return false
+	}
+}
+
+// enforceFilter deletes a message that matched the filter, and does the
+// filter's action to whoever sent it (warnings count towards the group's
+// warn_mute_at and warn_ban_at, see warnUser).
+func enforceFilter(bot *telegram.Bot, message *telegram.Message, filter database.Filter) {
+	group, user := message.Chat, message.Sender
+	log.Printf(
+		"%v (%v) sent a message matching filter #%v in %v (%v), %v.\n",
+		user.Username, user.ID, filter.ID, group.Username, group.ID, filter.Action,
+	)
+
+	err := bot.Delete(message)
+	if err != nil {
+		log.Printf(
+			"Could not delete message sent by %v (%v) in %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+	}
+
+	mention := helpers.MentionHTML(user.ID, user.Username, user.FirstName)
+	switch filter.Action {
+	case "warn":
+		bot.Send(
+			group, warnUser(bot, group, user, nil, fmt.Sprintf("matched filter #%v", filter.ID)),
+			telegram.ModeHTML,
+		)
+	case "mute":
+		duration := settingDuration(group, "filter_mute_duration")
+		moderateUser(bot, group, user, nil, database.ActionMute, duration, fmt.Sprintf("matched filter #%v", filter.ID))
+		bot.Send(
+			group,
+			fmt.Sprintf("🔇 %v, that's not allowed here! You're muted for %v.", mention, duration),
+			telegram.ModeHTML,
+		)
+	case "ban":
+		// Automatic, so not shared with the federation
+		database.BanUserLocally(bot, group, user, nil)
+		database.LogModerationAction(user, group, database.ActionBan, fmt.Sprintf("matched filter #%v", filter.ID), 0, nil)
+		bot.Send(
+			group,
+			fmt.Sprintf("%v sent something that's not allowed here, removing!", mention),
+			telegram.ModeHTML,
+		)
+	}
+}
+
+// constructFilterList lists (in HTML) the group's filters, for /filter list.
+func constructFilterList(group *telegram.Chat) string {
+	filters := database.GetFilters(group)
+	if len(filters) == 0 {
+		return "This group has no filters! (" + filterUsage + ")"
+	}
+
+	lines := []string{"<b>Filters</b>"}
+	for _, filter := range filters {
+		lines = append(lines, fmt.Sprintf(
+			"#%v: <code>%v</code> (%v)",
+			filter.ID, html.EscapeString(filter.Pattern), filter.Action,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// describeFilterAction describes what is done to messages matching
+// a filter with the given action.
+func describeFilterAction(action string) string {
+	switch action {
+	case "warn":
+		return "delete and warn about"
+	case "mute":
+		return "delete and mute the senders of"
+	case "ban":
+		return "delete and ban the senders of"
+	default:
+		return "delete"
+	}
+}
@@ -1,15 +1,32 @@
 package handlers
 
 import (
+	"bigboofer/classifier"
 	"bigboofer/database"
+	"bigboofer/helpers"
 
 	"fmt"
+	"html"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	telegram "gopkg.in/tucnak/telebot.v2"
 )
 
+// ReminderLifetime is how long a reminder mentioning an unvetted user in the
+// group (when they can't be PMed) stays up before being deleted.
+const ReminderLifetime = 30 * time.Second
+
+// WelcomeApproveButton and WelcomeKickButton are the admin-only inline
+// buttons attached to the welcome message. Their callbacks need to be
+// registered in run.go.
+var (
+	WelcomeApproveButton = telegram.InlineButton{Unique: "welcome_approve", Text: "✅ Approve"}
+	WelcomeKickButton    = telegram.InlineButton{Unique: "welcome_kick", Text: "❌ Kick"}
+)
+
 // OnAddedToGroup handles what should happen when the bot is
 // newly added to a group.
 func OnAddedToGroup(bot *telegram.Bot, message *telegram.Message) {
@@ -22,14 +39,26 @@ func OnAddedToGroup(bot *telegram.Bot, message *telegram.Message) {
 }
 
 // OnUserJoined handles what should happen when
-// the bot sees a new user join a group it is a part of.
+// the bot sees new users join a group it is a part of.
+// Bots added by non-admins are removed right away.
+// Everyone joining in the same event (e.g. when several users are added
+// at once) is challenged and welcomed in a single message. If too many users
+// join at once, the group is locked down (see recordJoins). Newcomers nobody
+// vouches for are screened by how spammy their profile looks (see screenByRisk).
 func OnUserJoined(bot *telegram.Bot, message *telegram.Message) {
+	newUsers := removeUnwantedBots(bot, message, joinedUsers(message))
+	if len(newUsers) == 0 {
+		return
+	}
+
 	if database.GetAuthChannel(message.Chat) == "" {
-		log.Printf(
-			"New user %v (%v) in %v (%v), but auth channel was not set here.\n",
-			message.UserJoined.Username, message.UserJoined.ID,
-			message.Chat.Username, message.Chat.ID,
-		)
+		for _, user := range newUsers {
+			log.Printf(
+				"New user %v (%v) in %v (%v), but auth channel was not set here.\n",
+				user.Username, user.ID,
+				message.Chat.Username, message.Chat.ID,
+			)
+		}
 
 		bot.Send(
 			message.Chat,
@@ -39,28 +68,312 @@ func OnUserJoined(bot *telegram.Bot, message *telegram.Message) {
 		return
 	}
 
+	var challenges []database.Challenge
+	for _, user := range newUsers {
+		if punishBlocklisted(bot, message.Chat, user) {
+			continue
+		}
+		if punishFederationBans(bot, message.Chat, user) {
+			continue
+		}
+		if punishRejoins(bot, message.Chat, user) {
+			continue
+		}
+		if quarantineImpersonator(bot, message.Chat, user, "joined") {
+			continue
+		}
+		if isReturningMember(message.Chat, user) {
+			continue
+		}
+		if trustedByAdder(bot, message, user) {
+			database.ExemptUser(user, message.Chat, message.Sender)
+			continue
+		}
+		if verifiedElsewhere(message.Chat, user) {
+			database.ExemptUser(user, message.Chat, nil)
+			continue
+		}
+		risk := screenByRisk(bot, message.Chat, user)
+		if risk == database.RiskBanned || risk == database.RiskApproved {
+			continue
+		}
+
+		log.Printf(
+			"New user %v (%v) in %v (%v), issuing challenge.\n",
+			user.Username, user.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+
+		challenges = append(challenges, database.Challenge{
+			UserID:      user.ID,
+			Username:    user.Username,
+			DisplayName: strings.TrimSpace(user.FirstName + " " + user.LastName),
+			Token:       database.AddUser(user, message.Chat),
+		})
+		if risk == database.RiskStrictChallenged {
+			challengeStrictly(bot, message.Chat, user, settingDuration(message.Chat, "lockdown_timeout"))
+		}
+	}
+
+	if len(challenges) == 0 {
+		return
+	}
+
+	// Only newcomers we challenge count towards a raid (not those we
+	// banned, trusted or let back in right away)
+	if recordJoins(bot, message.Chat, len(challenges)) {
+		sendLockdownWelcome(bot, message.Chat, challenges)
+	} else {
+		sendWelcome(bot, message.Chat, challenges)
+	}
+}
+
+// joinedUsers returns every user who joined in a join event.
+// (Telegram sets UserJoined to the first of UsersJoined.)
+func joinedUsers(message *telegram.Message) []*telegram.User {
+	var users []*telegram.User
+
+	for i := range message.UsersJoined {
+		users = append(users, &message.UsersJoined[i])
+	}
+
+	if len(users) == 0 && message.UserJoined != nil {
+		users = append(users, message.UserJoined)
+	}
+
+	return users
+}
+
+// sendWelcome welcomes newly challenged users to the group in a single
+// message, with buttons for them to answer in a PM and for admins.
+func sendWelcome(bot *telegram.Bot, group *telegram.Chat, challenges []database.Challenge) {
+	if len(challenges) == 0 {
+		return
+	}
+
+	var users []*telegram.User
+	var mentions []string
+	for i := range challenges {
+		user := challenges[i].User()
+		users = append(users, user)
+		mentions = append(mentions, helpers.MentionHTML(user.ID, user.Username, user.FirstName))
+	}
+
+	adminHint := " Admins, you can approve or kick this user with the buttons below."
+	if len(users) > 1 {
+		adminHint = " Admins, you can approve or kick these users with the buttons below."
+	}
+
+	welcome, err := bot.Send(
+		group,
+		constructVetMessage(
+			helpers.JoinList(mentions),
+			database.GetAuthChannel(group),
+		)+" You can also answer privately by tapping \"Verify me\"."+adminHint,
+		constructVetKeyboard(bot, challenges),
+		telegram.ModeHTML,
+		telegram.NoPreview,
+	)
+
+	if err != nil {
+		log.Printf(
+			"Could not welcome new users to %v (%v)!! %v\n",
+			group.Username, group.ID, err,
+		)
+		return
+	}
+
+	database.SetWelcomeMessage(group, users, welcome.ID)
+}
+
+// OnUserLeft handles what should happen when the bot sees a user leave
+// (or get removed from) a group it is a part of. If they were still being
+// challenged, the challenge is cleared, and if they left on their own,
+// the departure is recorded (see punishRejoins).
+func OnUserLeft(bot *telegram.Bot, message *telegram.Message) {
+	user := message.UserLeft
+	if user.ID == bot.Me.ID || database.GetMemberState(user, message.Chat) != database.MemberPending {
+		return
+	}
+
+	if message.Sender != nil && message.Sender.ID == user.ID {
+		log.Printf(
+			"%v (%v) left %v (%v) before answering the challenge.\n",
+			user.Username, user.ID, message.Chat.Username, message.Chat.ID,
+		)
+		database.AddDeparture(user, message.Chat)
+	} else {
+		log.Printf(
+			"%v (%v) was removed from %v (%v) before answering the challenge.\n",
+			user.Username, user.ID, message.Chat.Username, message.Chat.ID,
+		)
+	}
+
+	database.FailUser(user, message.Chat, message.Sender)
+}
+
+// punishRejoins bans a user who keeps leaving and rejoining the group before
+// answering the challenge (e.g. to reset their timer). Returns true if they
+// were banned.
+func punishRejoins(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) bool {
+	if database.MaxPendingDepartures == 0 ||
+		database.CountRecentDepartures(user, group) < database.MaxPendingDepartures {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) rejoined %v (%v) too many times without answering, banning.\n",
+		user.Username, user.ID, group.Username, group.ID,
+	)
+
+	moderateUser(bot, group, user, nil, database.ActionBan, 0, "kept rejoining without answering the challenge")
+	bot.Send(
+		group,
+		fmt.Sprintf(
+			"%v keeps leaving and rejoining without answering the challenge, removing!",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+		),
+		telegram.ModeHTML,
+	)
+	return true
+}
+
+// OnWelcomeApproveButton approves a user from their welcome message.
+func OnWelcomeApproveButton(bot *telegram.Bot, callback *telegram.Callback) {
+	user, ok := validateWelcomeButton(bot, callback)
+	if !ok {
+		return
+	}
+
+	approveUser(bot, callback.Message.Chat, user, callback.Sender)
+	log.Printf(
+		"%v (%v) approved %v from the welcome message in %v (%v)",
+		callback.Sender.Username, callback.Sender.ID, user.ID,
+		callback.Message.Chat.Username, callback.Message.Chat.ID,
+	)
+
+	bot.Respond(callback, &telegram.CallbackResponse{Text: "Approved! ▽・ω・▽"})
+	refreshWelcome(bot, callback, fmt.Sprintf(
+		"✅ %v approved by %v.",
+		html.EscapeString(helpers.DisplayName(user)), html.EscapeString(helpers.DisplayName(callback.Sender)),
+	))
+}
+
+// OnWelcomeKickButton kicks a user from their welcome message.
+func OnWelcomeKickButton(bot *telegram.Bot, callback *telegram.Callback) {
+	user, ok := validateWelcomeButton(bot, callback)
+	if !ok {
+		return
+	}
+
+	moderateUser(bot, callback.Message.Chat, user, callback.Sender, database.ActionKick, 0, "kicked from the welcome message")
 	log.Printf(
-		"New user %v (%v) in %v (%v), issuing challenge.\n",
-		message.UserJoined.Username, message.UserJoined.ID,
-		message.Chat.Username, message.Chat.ID,
+		"%v (%v) kicked %v from the welcome message in %v (%v)",
+		callback.Sender.Username, callback.Sender.ID, user.ID,
+		callback.Message.Chat.Username, callback.Message.Chat.ID,
 	)
 
-	database.AddUser(message.UserJoined, message.Chat)
-	bot.Send(message.Chat, constructVetMessage(
-		message.UserJoined.Username,
-		database.GetAuthChannel(message.Chat),
+	bot.Respond(callback, &telegram.CallbackResponse{Text: "Kicked!"})
+	refreshWelcome(bot, callback, fmt.Sprintf(
+		"❌ %v kicked by %v.",
+		html.EscapeString(helpers.DisplayName(user)), html.EscapeString(helpers.DisplayName(callback.Sender)),
 	))
 }
 
+// validateWelcomeButton returns the user a welcome message button is for, and
+// true if it was pressed by an admin and the user is still being challenged.
+// If the user isn't being challenged anymore, their buttons are removed.
+func validateWelcomeButton(bot *telegram.Bot, callback *telegram.Callback) (*telegram.User, bool) {
+	if !validateAdminButton(bot, callback) {
+		return nil, false
+	}
+
+	userID, _ := strconv.Atoi(callback.Data)
+	for _, challenge := range database.GetChallengesForWelcome(callback.Message.Chat, callback.Message.ID) {
+		if challenge.UserID == userID {
+			return challenge.User(), true
+		}
+	}
+
+	bot.Respond(callback, &telegram.CallbackResponse{Text: "This user is no longer pending."})
+	refreshWelcome(bot, callback, "")
+	return nil, false
+}
+
+// refreshWelcome appends a line (if any, in HTML) to the welcome message the
+// callback came from, and only keeps the buttons of users still being challenged.
+func refreshWelcome(bot *telegram.Bot, callback *telegram.Callback, line string) {
+	text := helpers.MessageHTML(callback.Message.Text, callback.Message.Entities)
+	if line != "" {
+		text += "\n\n" + line
+	}
+
+	options := []interface{}{telegram.ModeHTML, telegram.NoPreview}
+	challenges := database.GetChallengesForWelcome(callback.Message.Chat, callback.Message.ID)
+	if len(challenges) > 0 {
+		options = append(options, constructVetKeyboard(bot, challenges))
+	}
+
+	bot.Edit(callback.Message, text, options...)
+}
+
+// constructVetKeyboard returns the buttons to attach to the welcome message
+// for the given challenges: for each user, a link to answer the challenge
+// in a PM, and admin buttons.
+func constructVetKeyboard(bot *telegram.Bot, challenges []database.Challenge) *telegram.ReplyMarkup {
+	var keyboard [][]telegram.InlineButton
+
+	for i := range challenges {
+		user := challenges[i].User()
+		approveButton, kickButton := WelcomeApproveButton, WelcomeKickButton
+		approveButton.Data = strconv.Itoa(user.ID)
+		kickButton.Data = strconv.Itoa(user.ID)
+
+		verifyButton := telegram.InlineButton{
+			Text: "🔑 Verify me",
+			URL:  fmt.Sprintf("https://t.me/%v?start=%v", bot.Me.Username, challenges[i].Token),
+		}
+
+		if len(challenges) > 1 {
+			// Say who each row is for
+			verifyButton.Text = "🔑 " + helpers.DisplayName(user)
+			approveButton.Text = "✅"
+			kickButton.Text = "❌"
+		}
+
+		keyboard = append(keyboard, []telegram.InlineButton{verifyButton, approveButton, kickButton})
+	}
+
+	return &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
 // OnMessage encomposes the following events: OnText, OnPhoto, OnAudio,
 // OnDocument, OnSticker, OnVideo, OnVoice, OnVideoNote, OnContact,
 // OnLocation, OnVenue. If a non-vetted non-admin in a group chat
 // attempts to send a message, it will be automatically deleted
-// and a PM will be sent restating instructions on how to be vetted.
+// and a PM will be sent restating instructions on how to be vetted
+// (at most once every reminder_interval). Messages from everyone
+// else are moderated (see moderateMessage).
 func OnMessage(bot *telegram.Bot, message *telegram.Message) {
-	if !message.FromGroup() ||
-		database.UserWasVetted(message.Sender, message.Chat) {
-		// Either it was a PM, or it was a group message from someone already vetted.
+	if message.Private() {
+		// Newcomers may answer the challenge in a PM
+		onPrivateMessage(bot, message)
+		return
+	}
+
+	if !message.FromGroup() {
+		return
+	}
+
+	member := database.GetMember(message.Sender, message.Chat)
+	if member.State == database.MemberQuarantined {
+		// Quarantined users should be muted, but we may lack the permission to.
+		bot.Delete(message)
+		return
+	}
+	if member.State != database.MemberPending {
+		// From someone already vetted
+		moderateMessage(bot, message, member)
 		return
 	}
 
@@ -69,21 +382,7 @@ func OnMessage(bot *telegram.Bot, message *telegram.Message) {
 	if !strings.HasPrefix(message.Text, "/") &&
 		database.CheckPassphrase(message.Chat, message.Text) {
 		// Passphrase matches! Vet this user.
-		database.VetUser(message.Sender, message.Chat)
-
-		log.Printf(
-			"User %v (%v) was vetted in %v (%v)",
-			message.Sender.Username, message.Sender.ID,
-			message.Chat.Username, message.Chat.ID,
-		)
-
-		bot.Send(
-			message.Chat,
-			fmt.Sprintf(
-				"Woof!! Thanks, @%v! You are free to chat as you wish. ▽ - ω - ▽",
-				message.Sender.Username,
-			),
-		)
+		passChallenge(bot, message.Chat, message.Sender)
 
 		// Delete the message to clean up
 		bot.Delete(message)
@@ -91,8 +390,13 @@ func OnMessage(bot *telegram.Bot, message *telegram.Message) {
 		return
 	}
 
-	// Delete the message,
+	// Delete the message (and learn from it if they turn out to be a spammer),
 	err := bot.Delete(message)
+	if !strings.HasPrefix(message.Text, "/") {
+		database.HoldSpamEvidence(
+			message.Sender, message.Chat, message.ID, classifier.Tokenize(messageText(message)),
+		)
+	}
 
 	if err != nil {
 		log.Printf(
@@ -105,26 +409,194 @@ func OnMessage(bot *telegram.Bot, message *telegram.Message) {
 		)
 	}
 
-	// ...and PM the user.
+	// ...and remind the user (unless we did so recently).
+	if database.MarkUserReminded(message.Sender, message.Chat, settingDuration(message.Chat, "reminder_interval")) {
+		remindUser(bot, message.Chat, message.Sender)
+	}
+}
+
+// moderateMessage checks a message sent in the group by someone who isn't
+// being challenged: if they changed their name since we last saw them, whether
+// they look like an admin (see quarantineImpersonator), whether it matches
+// one of the group's filters (see applyFilters), whether it looks like spam
+// (see checkSpam), and whether they may send it yet (see enforceProbation).
+// Returns true if it was deleted.
+func moderateMessage(bot *telegram.Bot, message *telegram.Message, member database.Member) bool {
+	if database.UpdateMemberName(message.Sender, message.Chat) &&
+		quarantineImpersonator(bot, message.Chat, message.Sender, "changed their name") {
+		bot.Delete(message)
+		return true
+	}
+
+	return applyFilters(bot, message, member) ||
+		checkSpam(bot, message, member) ||
+		enforceProbation(bot, message, member)
+}
+
+// remindUser PMs an unvetted user the instructions on how to be vetted.
+// If we can't PM them (e.g. they never started a chat with us), they are
+// mentioned in the group instead, and the mention is deleted shortly after.
+func remindUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	_, err := bot.Send(
+		user, constructVetMessage(
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			database.GetAuthChannel(group),
+		)+" You can also just reply to me here with the passphrase.",
+		telegram.ModeHTML,
+		telegram.NoPreview,
+	)
+
+	if err == nil {
+		return
+	}
+
+	log.Printf(
+		"Could not PM %v (%v), reminding them in %v (%v) instead. %v\n",
+		user.Username, user.ID, group.Username, group.ID, err,
+	)
+
+	reminder, err := bot.Send(
+		group,
+		fmt.Sprintf(
+			"%v, please answer the challenge in the welcome message before chatting! ▽・ω・▽",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+		),
+		telegram.ModeHTML,
+		telegram.Silent,
+	)
+
+	if err != nil {
+		return
+	}
+
+	go func() {
+		time.Sleep(ReminderLifetime)
+		bot.Delete(reminder)
+	}()
+}
+
+// passChallenge vets a user who answered the challenge correctly,
+// and lets the group know.
+func passChallenge(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	approveUser(bot, group, user, user)
+
+	log.Printf(
+		"User %v (%v) was vetted in %v (%v)",
+		user.Username, user.ID,
+		group.Username, group.ID,
+	)
+
 	bot.Send(
-		message.Sender, constructVetMessage(
-			message.Sender.Username,
-			database.GetAuthChannel(message.Chat),
+		group,
+		fmt.Sprintf(
+			"Woof!! Thanks, %v! You are free to chat as you wish. ▽ - ω - ▽",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName),
 		),
+		telegram.ModeHTML,
 	)
 }
 
-// constructVetMessage returns the string to send an unvetted user
-// on join or on message send before vetting.
-func constructVetMessage(username string, rulesURL string) string {
+// approveUser vets a user in the group (see database.VetUser), or releases them
+// if they were quarantined (see database.ReleaseUser), and lifts the
+// restrictions placed on them if their challenge was strict or they were
+// quarantined. by is who approved them (the user themselves if they answered
+// the challenge).
+func approveUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User) {
+	quarantined := database.GetMemberState(user, group) == database.MemberQuarantined
+	restricted := quarantined || database.ChallengeIsStrict(user, group)
+
+	if quarantined {
+		database.ReleaseUser(user, group, by)
+	} else {
+		database.VetUser(user, group, by)
+	}
+
+	if !restricted {
+		return
+	}
+
+	err := bot.Restrict(group, &telegram.ChatMember{User: user, Rights: telegram.NoRestrictions()})
+	if err != nil {
+		log.Printf(
+			"Could not lift restrictions on %v (%v) in %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+	}
+}
+
+// challengeStrictly mutes a newly challenged user in the group, and makes
+// their challenge strict (see database.MakeChallengeStrict), giving them the
+// given time to answer privately.
+func challengeStrictly(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, timeout time.Duration) {
+	muteUser(bot, group, user, 0)
+	database.MakeChallengeStrict(user, group, timeout)
+}
+
+// muteUser stops a user from sending anything in the group for the given
+// duration (Telegram lifts it by itself), or until unmuted if it is 0.
+func muteUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, duration time.Duration) {
+	var until int64
+	if duration > 0 {
+		until = time.Now().Add(duration).Unix()
+	}
+
+	err := bot.Restrict(group, &telegram.ChatMember{User: user, Rights: telegram.NoRights(), RestrictedUntil: until})
+
+	if err != nil {
+		log.Printf(
+			"Could not mute %v (%v) in %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+	}
+}
+
+// constructVetMessage returns the HTML to send unvetted users (given as
+// HTML mentions) on join or on message send before vetting.
+func constructVetMessage(mentions string, rulesURL string) string {
 	return fmt.Sprintf(
-		"Hello, @%v! Welcome to the group. Please read %v "+
+		"Hello, %v! Welcome to the group. Please read %v "+
 			"and reply with the passphrase written in the channel. "+
 			"To prevent spam, you will be prevented from sending "+
-			"messages until you do so. Admins, you can manually "+
-			"approve this user by typing /approve @%v.",
-		username,
-		rulesURL,
-		username,
+			"messages until you do so.",
+		mentions,
+		html.EscapeString(rulesURL),
 	)
 }
+
+// messageText returns the text of a message, or its caption.
+func messageText(message *telegram.Message) string {
+	if message.Text != "" {
+		return message.Text
+	}
+
+	return message.Caption
+}
+
+// messageEntities returns the entities (e.g. links and mentions) in the
+// text or caption of a message.
+func messageEntities(message *telegram.Message) []telegram.MessageEntity {
+	return append(append([]telegram.MessageEntity{}, message.Entities...), message.CaptionEntities...)
+}
+
+// messageMedia returns what kind of media a message contains (e.g. "photo"),
+// or an empty string if it doesn't contain any.
+func messageMedia(message *telegram.Message) string {
+	switch {
+	case message.Photo != nil:
+		return "photo"
+	case message.Video != nil:
+		return "video"
+	case message.VideoNote != nil:
+		return "video note"
+	case message.Audio != nil:
+		return "audio"
+	case message.Voice != nil:
+		return "voice message"
+	case message.Document != nil:
+		return "file"
+	case message.Sticker != nil:
+		return "sticker"
+	default:
+		return ""
+	}
+}
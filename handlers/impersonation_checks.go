@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// AdminCacheLifetime is how long the list of a group's admins is kept before
+// being fetched again for checks run on every message (see cachedAdminsOf).
+const AdminCacheLifetime = 10 * time.Minute
+
+// MinImpersonatedNameLength is the length (once folded, see
+// helpers.FoldConfusables) under which admin names are too short
+// to be told apart from lookalikes, and aren't checked.
+const MinImpersonatedNameLength = 4
+
+// MinLoneImpersonatedNameLength is the length (once folded) under which admin
+// names are common enough (e.g. "Alex") that sharing one isn't suspicious on
+// its own: users must look like the admin by both their name and username.
+const MinLoneImpersonatedNameLength = 6
+
+// impersonationKeywords are words impersonators put in their names to pass as
+// staff. A word of a name starting or ending with one of these is suspicious.
+var impersonationKeywords = []string{"admin", "moderator"}
+
+// cachedAdmins is the list of a group's admins, and when it was fetched.
+type cachedAdmins struct {
+	Admins    []telegram.ChatMember
+	FetchedOn time.Time
+}
+
+// adminCache keeps the list of every group's admins (in memory), so checking
+// every message (e.g. for impersonators) doesn't fetch it every time.
+var adminCache = struct {
+	sync.Mutex
+	groups map[int64]cachedAdmins
+}{
+	groups: make(map[int64]cachedAdmins),
+}
+
+// cachedAdminsOf returns the admins of the group, fetching them again
+// if they were fetched more than AdminCacheLifetime ago.
+func cachedAdminsOf(bot *telegram.Bot, group *telegram.Chat) []telegram.ChatMember {
+	adminCache.Lock()
+	cached, found := adminCache.groups[group.ID]
+	adminCache.Unlock()
+
+	if found && time.Since(cached.FetchedOn) < AdminCacheLifetime {
+		return cached.Admins
+	}
+
+	admins, err := bot.AdminsOf(group)
+	if err != nil {
+		log.Printf(
+			"Could not get the admins of %v (%v)!! %v\n",
+			group.Username, group.ID, err,
+		)
+		return cached.Admins
+	}
+
+	adminCache.Lock()
+	adminCache.groups[group.ID] = cachedAdmins{Admins: admins, FetchedOn: time.Now()}
+	adminCache.Unlock()
+	return admins
+}
+
+// impersonatedAdmin returns a description (in HTML) of the admin the user's
+// name or username looks like, and true if it looks like one: either a lookalike
+// of an actual admin's name (see helpers.FoldConfusables and helpers.EditDistance),
+// or a name passing as staff (e.g. "Group Admin"). Admins never impersonate anyone.
+func impersonatedAdmin(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) (string, bool) {
+	admins := cachedAdminsOf(bot, group)
+	if helpers.ChatMemberContains(&admins, user) {
+		return "", false
+	}
+
+	names := foldNames(user)
+	for _, name := range names {
+		for _, word := range strings.Fields(name) {
+			for _, keyword := range impersonationKeywords {
+				if strings.HasPrefix(word, keyword) || strings.HasSuffix(word, keyword) {
+					return "an admin", true
+				}
+			}
+		}
+	}
+
+	for _, admin := range admins {
+		if admin.User == nil || admin.User.IsBot {
+			continue
+		}
+
+		if matches, short := countLookalikeNames(names, foldNames(admin.User)); matches > 0 &&
+			(!short || matches == 2) {
+			return "admin " + helpers.MentionHTML(
+				admin.User.ID, admin.User.Username, admin.User.FirstName,
+			), true
+		}
+	}
+
+	return "", false
+}
+
+// countLookalikeNames returns how many of a user's (folded) names look like
+// one of an admin's, and true if any of the admin's names they look like is
+// shorter than MinLoneImpersonatedNameLength.
+func countLookalikeNames(names []string, adminNames []string) (int, bool) {
+	matches, short := 0, false
+
+	for _, name := range names {
+		name = strings.Replace(name, " ", "", -1)
+
+		for _, adminName := range adminNames {
+			adminName = strings.Replace(adminName, " ", "", -1)
+			if len(adminName) < MinImpersonatedNameLength {
+				continue
+			}
+
+			if helpers.EditDistance(name, adminName) <= maxImpersonationDistance(len(adminName)) {
+				matches++
+				short = short || len(adminName) < MinLoneImpersonatedNameLength
+				break
+			}
+		}
+	}
+
+	return matches, short
+}
+
+// foldNames returns the name and username of a user (if they have
+// them), folded with helpers.FoldConfusables.
+func foldNames(user *telegram.User) []string {
+	var names []string
+
+	for _, name := range []string{user.FirstName + " " + user.LastName, user.Username} {
+		if folded := helpers.FoldConfusables(name); folded != "" {
+			names = append(names, folded)
+		}
+	}
+
+	return names
+}
+
+// maxImpersonationDistance returns how many characters a name may differ
+// by from an admin's name of the given length to be a lookalike of it.
+func maxImpersonationDistance(length int) int {
+	switch {
+	case length < 6:
+		return 0
+	case length < 12:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// quarantineImpersonator mutes a user who looks like they're impersonating an
+// admin of the group (see impersonatedAdmin) and quarantines them until an admin
+// approves them, if the group's impersonation_checks setting is on. Their admins
+// are told what the user did (e.g. "joined"). Returns true if they were quarantined.
+func quarantineImpersonator(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, did string) bool {
+	if !settingEnabled(group, "impersonation_checks") {
+		return false
+	}
+
+	lookalike, found := impersonatedAdmin(bot, group, user)
+	if !found {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) %v in %v (%v) and looks like %v, quarantining.\n",
+		user.Username, user.ID, did, group.Username, group.ID, lookalike,
+	)
+
+	muteUser(bot, group, user, 0)
+	database.QuarantineUser(user, group, nil)
+	notifyAdmins(bot, group, fmt.Sprintf(
+		"🕵️ %v (%v) %v in %v, and looks like %v, so I muted them. "+
+			"If they aren't impersonating anyone, run /approve %v there "+
+			"(or /reject %v to remove them).",
+		helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+		html.EscapeString(helpers.DisplayName(user)), did,
+		html.EscapeString(groupName(group)), lookalike, user.ID, user.ID,
+	))
+	return true
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// trustedByAdder returns true if a new user doesn't need to be challenged
+// because of who added them to the group, according to the group's
+// trust_admin_adds and trust_member_adds settings. Users who joined by
+// themselves (e.g. through a link) are always challenged.
+func trustedByAdder(bot *telegram.Bot, message *telegram.Message, user *telegram.User) bool {
+	adder := message.Sender
+	group := message.Chat
+
+	if adder == nil || adder.ID == user.ID {
+		log.Printf(
+			"%v (%v) joined %v (%v) by themselves, challenging.\n",
+			user.Username, user.ID, group.Username, group.ID,
+		)
+		return false
+	}
+
+	if isAdmin(bot, group, adder) {
+		if settingEnabled(group, "trust_admin_adds") {
+			log.Printf(
+				"%v (%v) was added to %v (%v) by admin %v (%v), trusting.\n",
+				user.Username, user.ID, group.Username, group.ID,
+				adder.Username, adder.ID,
+			)
+			return true
+		}
+
+		log.Printf(
+			"%v (%v) was added to %v (%v) by admin %v (%v), but trust_admin_adds is off, challenging.\n",
+			user.Username, user.ID, group.Username, group.ID,
+			adder.Username, adder.ID,
+		)
+		return false
+	}
+
+	if settingEnabled(group, "trust_member_adds") && !adder.IsBot &&
+		isVerifiedMember(adder, group) {
+		log.Printf(
+			"%v (%v) was added to %v (%v) by verified member %v (%v), trusting.\n",
+			user.Username, user.ID, group.Username, group.ID,
+			adder.Username, adder.ID,
+		)
+		return true
+	}
+
+	log.Printf(
+		"%v (%v) was added to %v (%v) by member %v (%v), challenging.\n",
+		user.Username, user.ID, group.Username, group.ID,
+		adder.Username, adder.ID,
+	)
+	return false
+}
+
+// removeUnwantedBots kicks any bot account added by someone other than an
+// admin (unless it's on the group's allowlist), and lets the admins know.
+// Returns the remaining new users.
+func removeUnwantedBots(bot *telegram.Bot, message *telegram.Message, users []*telegram.User) []*telegram.User {
+	var remaining []*telegram.User
+	group := message.Chat
+
+	for _, user := range users {
+		if !user.IsBot {
+			remaining = append(remaining, user)
+			continue
+		}
+
+		if database.BotIsAllowed(group, user.Username) {
+			log.Printf(
+				"Bot %v (%v) was added to %v (%v), and is on the allowlist.\n",
+				user.Username, user.ID, group.Username, group.ID,
+			)
+			database.ExemptUser(user, group, message.Sender)
+			continue
+		}
+
+		if message.Sender != nil && isAdmin(bot, group, message.Sender) {
+			log.Printf(
+				"Bot %v (%v) was added to %v (%v) by admin %v (%v).\n",
+				user.Username, user.ID, group.Username, group.ID,
+				message.Sender.Username, message.Sender.ID,
+			)
+			database.ExemptUser(user, group, message.Sender)
+			continue
+		}
+
+		log.Printf(
+			"Bot %v (%v) was added to %v (%v) by non-admin, removing.\n",
+			user.Username, user.ID, group.Username, group.ID,
+		)
+		kickUser(bot, group, user)
+
+		adder := "someone"
+		if message.Sender != nil {
+			adder = helpers.MentionHTML(message.Sender.ID, message.Sender.Username, message.Sender.FirstName)
+		}
+		notifyAdmins(bot, group, fmt.Sprintf(
+			"I removed the bot @%v, which %v added to %v. "+
+				"If it's welcome, an admin can run /allowbot @%v and add it again.",
+			html.EscapeString(user.Username), adder, html.EscapeString(groupName(group)),
+			html.EscapeString(user.Username),
+		))
+	}
+
+	return remaining
+}
+
+// isVerifiedMember returns true if the user answered the challenge
+// in the group, or was approved or exempted there.
+func isVerifiedMember(user *telegram.User, group *telegram.Chat) bool {
+	state := database.GetMemberState(user, group)
+	return state == database.MemberVerified || state == database.MemberExempt
+}
+
+// isReturningMember returns true if a new user doesn't need to be challenged
+// because they were verified in the group recently enough, according to the
+// group's trust_returning_members and returning_member_expiry settings.
+// (Their verification is kept as is.)
+func isReturningMember(group *telegram.Chat, user *telegram.User) bool {
+	within := settingDuration(group, "returning_member_expiry")
+
+	if !settingEnabled(group, "trust_returning_members") ||
+		!database.UserVerifiedWithin(user, group, within) {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) rejoined %v (%v) and was verified there within %v, trusting.\n",
+		user.Username, user.ID, group.Username, group.ID, within,
+	)
+	return true
+}
+
+// verifiedElsewhere returns true if a new user doesn't need to be challenged
+// because the group shares verifications (or is in a federation that does),
+// and they were verified in another group sharing them recently enough
+// (see returning_member_expiry).
+func verifiedElsewhere(group *telegram.Chat, user *telegram.User) bool {
+	within := settingDuration(group, "returning_member_expiry")
+
+	if settingEnabled(group, database.ShareVerificationsSetting) &&
+		database.UserVerifiedElsewhereWithin(user, group, within) {
+		log.Printf(
+			"%v (%v) joined %v (%v) and was verified in a sharing group within %v, trusting.\n",
+			user.Username, user.ID, group.Username, group.ID, within,
+		)
+		return true
+	}
+
+	if database.UserVerifiedInFederationWithin(user, group, within) {
+		log.Printf(
+			"%v (%v) joined %v (%v) and was verified in its federation within %v, trusting.\n",
+			user.Username, user.ID, group.Username, group.ID, within,
+		)
+		return true
+	}
+
+	return false
+}
+
+// punishBlocklisted bans a new user who is on the group's blocklist or the
+// global blocklist, instead of challenging them. Returns true if they were banned.
+func punishBlocklisted(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) bool {
+	reason, blocked := database.GetBlocklistReason(user, group)
+	if !blocked {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) joined %v (%v), but is on the blocklist (%v), banning.\n",
+		user.Username, user.ID, group.Username, group.ID, reason,
+	)
+
+	moderateUser(bot, group, user, nil, database.ActionBan, 0, "on the blocklist: "+reason)
+	return true
+}
+
+// punishFederationBans bans a new user who was banned in another group of
+// the group's federation. Returns true if they were banned.
+func punishFederationBans(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) bool {
+	reason, banned := database.GetFederationBanReason(user, group)
+	if !banned {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) joined %v (%v), but is banned in its federation (%v), banning.\n",
+		user.Username, user.ID, group.Username, group.ID, reason,
+	)
+
+	moderateUser(bot, group, user, nil, database.ActionBan, 0, reason)
+	return true
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"bigboofer/database"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// LockdownStartPayload is the /start payload of the "Verify me" button
+// of lockdown welcome messages (which are for everyone, not one user).
+const LockdownStartPayload = "verify"
+
+// lockdown describes a group in lockdown.
+type lockdown struct {
+	Since    time.Time
+	LastJoin time.Time
+	Manual   bool
+	Welcome  *telegram.Message
+}
+
+// raids tracks recent joins in every group (in memory), and which groups
+// are in lockdown because of them (or because an admin said so).
+var raids = struct {
+	sync.Mutex
+	joins     map[int64][]time.Time
+	lockdowns map[int64]*lockdown
+}{
+	joins:     make(map[int64][]time.Time),
+	lockdowns: make(map[int64]*lockdown),
+}
+
+// OnLockdownCommand shows whether the group is in lockdown, or starts or ends
+// one. (/lockdown [on|off]) Checks that the user who sent the command is an
+// admin of the group they sent it in.
+func OnLockdownCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to run /lockdown %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, message.Payload,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateLockdownCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	switch normalizeSetting(boolSetting, strings.TrimSpace(message.Payload)) {
+	case "on":
+		startLockdown(message.Chat, true)
+		log.Printf(
+			"%v (%v) locked down %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		bot.Reply(message, "OK!! Locked down. Newcomers will be muted until they answer "+
+			"privately, and I'll stay locked down until you run /lockdown off.")
+	case "off":
+		endLockdown(bot, message.Chat)
+		log.Printf(
+			"%v (%v) ended the lockdown of %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		bot.Reply(message, "OK!! The lockdown is over. ▽・ω・▽")
+	default:
+		if inLockdown(message.Chat) {
+			bot.Reply(message, "This group is in lockdown. (/lockdown off to end it)")
+		} else {
+			bot.Reply(message, "This group isn't in lockdown. (/lockdown on to start one)")
+		}
+	}
+}
+
+// validateLockdownCommand returns true if all args are valid, returns false
+// and replies with a message explaining why if not
+func validateLockdownCommand(bot *telegram.Bot, message *telegram.Message) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+
+	payload := strings.TrimSpace(message.Payload)
+	if payload != "" && normalizeSetting(boolSetting, payload) == "" {
+		bot.Reply(message, "Please send on or off along with your command! (/lockdown [on|off])")
+		return false
+	}
+
+	return true
+}
+
+// recordJoins records that the given number of newcomers were just challenged in the group.
+// If at least raid_threshold users joined within raid_window, the group is
+// locked down (and its admins alerted). Returns true if the group is in lockdown.
+func recordJoins(bot *telegram.Bot, group *telegram.Chat, count int) bool {
+	threshold := settingInt(group, "raid_threshold")
+	window := settingDuration(group, "raid_window")
+	now := time.Now()
+
+	raids.Lock()
+	joins := raids.joins[group.ID]
+	// Forget joins that fell out of the window
+	for len(joins) > 0 && now.Sub(joins[0]) > window {
+		joins = joins[1:]
+	}
+	for i := 0; i < count; i++ {
+		joins = append(joins, now)
+	}
+	raids.joins[group.ID] = joins
+
+	current, locked := raids.lockdowns[group.ID]
+	if locked {
+		current.LastJoin = now
+	}
+	raiding := !locked && threshold > 0 && len(joins) >= threshold
+	if raiding {
+		raids.lockdowns[group.ID] = &lockdown{Since: now, LastJoin: now}
+	}
+	raids.Unlock()
+
+	if raiding {
+		log.Printf(
+			"%v users joined %v (%v) within %v, locking down.\n",
+			len(joins), group.Username, group.ID, window,
+		)
+		notifyAdmins(bot, group, fmt.Sprintf(
+			"🚨 %v users joined %v within %v, so I locked it down: newcomers are muted "+
+				"until they answer privately, and have %v to do so. The lockdown ends "+
+				"once nobody has joined for %v, or when an admin runs /lockdown off.",
+			len(joins), html.EscapeString(groupName(group)), window,
+			settingDuration(group, "lockdown_timeout"),
+			settingDuration(group, "lockdown_quiet_period"),
+		))
+	}
+
+	return locked || raiding
+}
+
+// inLockdown returns true if the group is in lockdown.
+func inLockdown(group *telegram.Chat) bool {
+	raids.Lock()
+	defer raids.Unlock()
+
+	_, locked := raids.lockdowns[group.ID]
+	return locked
+}
+
+// startLockdown locks down the group. Manual lockdowns don't end by themselves.
+func startLockdown(group *telegram.Chat, manual bool) {
+	raids.Lock()
+	defer raids.Unlock()
+
+	if current, locked := raids.lockdowns[group.ID]; locked {
+		current.Manual = current.Manual || manual
+		return
+	}
+
+	now := time.Now()
+	raids.lockdowns[group.ID] = &lockdown{Since: now, LastJoin: now, Manual: manual}
+}
+
+// endLockdown ends the lockdown of the group (if any),
+// and removes its welcome message.
+func endLockdown(bot *telegram.Bot, group *telegram.Chat) {
+	raids.Lock()
+	current, locked := raids.lockdowns[group.ID]
+	delete(raids.lockdowns, group.ID)
+	delete(raids.joins, group.ID)
+	raids.Unlock()
+
+	if locked && current.Welcome != nil {
+		bot.Delete(current.Welcome)
+	}
+}
+
+// EndQuietLockdowns ends the lockdown of every group nobody joined for
+// lockdown_quiet_period (unless an admin started it), and lets their admins know.
+func EndQuietLockdowns(bot *telegram.Bot) {
+	lastJoins := make(map[int64]time.Time)
+
+	raids.Lock()
+	for groupID, current := range raids.lockdowns {
+		if !current.Manual {
+			lastJoins[groupID] = current.LastJoin
+		}
+	}
+	raids.Unlock()
+
+	for groupID, lastJoin := range lastJoins {
+		group := &telegram.Chat{ID: groupID}
+		quietPeriod := settingDuration(group, "lockdown_quiet_period")
+		if time.Since(lastJoin) < quietPeriod {
+			continue
+		}
+
+		log.Printf("Nobody joined %v for %v, ending lockdown.\n", groupID, quietPeriod)
+		endLockdown(bot, group)
+		notifyAdmins(bot, group, fmt.Sprintf(
+			"Nobody joined for %v, so the lockdown is over. ▽・ω・▽", quietPeriod,
+		))
+	}
+}
+
+// sendLockdownWelcome mutes newly challenged users during a lockdown, gives
+// them lockdown_timeout to answer privately, and replaces the group's lockdown
+// welcome message (so there's only one, at the bottom of the chat).
+func sendLockdownWelcome(bot *telegram.Bot, group *telegram.Chat, challenges []database.Challenge) {
+	if len(challenges) == 0 {
+		return
+	}
+
+	timeout := settingDuration(group, "lockdown_timeout")
+	for i := range challenges {
+		challengeStrictly(bot, group, challenges[i].User(), timeout)
+	}
+
+	welcome, err := bot.Send(
+		group,
+		fmt.Sprintf(
+			"🚨 This group is in lockdown, because a lot of people are joining at once. "+
+				"If you just joined, welcome! Please read %v, then tap \"Verify me\" and "+
+				"send me the passphrase written in the channel within %v. Until then, "+
+				"you can't send messages here. (%v newcomers waiting)",
+			html.EscapeString(database.GetAuthChannel(group)), timeout,
+			database.CountChallengesForChat(group),
+		),
+		&telegram.ReplyMarkup{InlineKeyboard: [][]telegram.InlineButton{{{
+			Text: "🔑 Verify me",
+			URL:  fmt.Sprintf("https://t.me/%v?start=%v", bot.Me.Username, LockdownStartPayload),
+		}}}},
+		telegram.ModeHTML,
+		telegram.NoPreview,
+		telegram.Silent,
+	)
+
+	if err != nil {
+		log.Printf(
+			"Could not welcome new users to %v (%v)!! %v\n",
+			group.Username, group.ID, err,
+		)
+		return
+	}
+
+	raids.Lock()
+	var previous *telegram.Message
+	if current, locked := raids.lockdowns[group.ID]; locked {
+		previous, current.Welcome = current.Welcome, welcome
+	}
+	raids.Unlock()
+
+	if previous != nil {
+		bot.Delete(previous)
+	}
+}
+
+// describeLockdown describes (in HTML) whether the group is in lockdown, for /status.
+func describeLockdown(group *telegram.Chat) string {
+	raids.Lock()
+	defer raids.Unlock()
+
+	current, locked := raids.lockdowns[group.ID]
+	if !locked {
+		return "off"
+	}
+
+	how := "automatic"
+	if current.Manual {
+		how = "started by an admin"
+	}
+
+	return fmt.Sprintf("on since %v (%v)", current.Since.UTC().Format("15:04 UTC"), how)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// MemberHistoryLength is the number of changes shown by /member.
+const MemberHistoryLength = 5
+
+// OnMemberCommand replies with what we know about the provided user in the group:
+// their state, when they joined and were verified (and by whom), their risk score,
+// their history and their first messages on probation.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnMemberCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is looking up a member in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	user, _ := parseTargetArgs(message)
+	if user == nil {
+		bot.Reply(message, "Please send a username along with your command! (/member @<username>)")
+		return
+	}
+
+	member := database.GetMember(user, message.Chat)
+	if user.ID == 0 || member.State == database.MemberUnknown {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"I've never seen %v join here!",
+				helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			),
+			telegram.ModeHTML,
+		)
+		return
+	}
+
+	if user.Username == "" {
+		user.Username = member.Username
+	}
+
+	var risk *database.RiskScore
+	if score, scored := database.GetRiskScore(user, message.Chat); scored {
+		risk = &score
+	}
+
+	report := constructMemberReport(member, user, risk, database.GetMemberHistory(user, message.Chat, MemberHistoryLength))
+	if probation := constructProbationReport(user, message.Chat, member); probation != "" {
+		report += "\n\n" + probation
+	}
+
+	bot.Reply(message, report, telegram.ModeHTML)
+}
+
+// constructMemberReport describes a member (in HTML) for /member.
+// risk is their latest risk score (nil if they were never scored).
+func constructMemberReport(member database.Member, user *telegram.User, risk *database.RiskScore, history []database.MemberEvent) string {
+	lines := []string{
+		fmt.Sprintf(
+			"<b>%v</b>: %v",
+			helpers.MentionHTML(user.ID, user.Username, user.FirstName), member.State,
+		),
+		"Joined: " + formatMemberTime(member.JoinedOn),
+	}
+
+	if !member.VerifiedOn.IsZero() {
+		lines = append(lines, fmt.Sprintf(
+			"Verified: %v by %v",
+			formatMemberTime(member.VerifiedOn), describeActor(member.VerifiedBy, member.UserID),
+		))
+	}
+
+	if risk != nil {
+		lines = append(lines, fmt.Sprintf(
+			"Screened: %v, %v", describeRisk(risk.Score, risk.Signals), risk.Outcome,
+		))
+	}
+
+	if len(history) > 0 {
+		lines = append(lines, "", "<b>History</b>")
+	}
+	for _, event := range history {
+		lines = append(lines, fmt.Sprintf(
+			"%v: %v by %v",
+			formatMemberTime(event.ChangedOn), event.State, describeActor(event.ChangedBy, member.UserID),
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// describeActor describes (in HTML) who changed a member's state.
+func describeActor(actorID int, memberID int) string {
+	switch actorID {
+	case 0:
+		return "me"
+	case memberID:
+		return "themselves"
+	default:
+		return helpers.MentionHTML(actorID, "", "")
+	}
+}
+
+// formatMemberTime formats a time from a member's record,
+// or returns "unknown" if it's not set.
+func formatMemberTime(timestamp time.Time) string {
+	if timestamp.IsZero() {
+		return "unknown"
+	}
+
+	return timestamp.Format("2006-01-02 15:04 UTC")
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// ModerationLogLength is the number of actions listed by /modlog.
+const ModerationLogLength = 10
+
+// OnBanCommand bans the provided user from the group (and from every group
+// in its federation, if it's in one), for the given duration or for good.
+// (/ban @<username> [duration] [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnBanCommand(bot *telegram.Bot, message *telegram.Message) {
+	onModerationCommand(bot, message, database.ActionBan, "/ban @<username> [duration, e.g. 1d] [reason]")
+}
+
+// OnUnbanCommand unbans the provided user from the group, so they can join
+// again (and lifts their ban in its federation, if it's in one).
+// (/unban @<username> [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnUnbanCommand(bot *telegram.Bot, message *telegram.Message) {
+	onModerationCommand(bot, message, database.ActionUnban, "/unban @<username> [reason]")
+}
+
+// OnKickCommand removes the provided user from the group without banning
+// them, so they may rejoin later. (/kick @<username> [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnKickCommand(bot *telegram.Bot, message *telegram.Message) {
+	onModerationCommand(bot, message, database.ActionKick, "/kick @<username> [reason]")
+}
+
+// OnMuteCommand stops the provided user from sending anything in the group,
+// for the given duration or until unmuted. (/mute @<username> [duration] [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnMuteCommand(bot *telegram.Bot, message *telegram.Message) {
+	onModerationCommand(bot, message, database.ActionMute, "/mute @<username> [duration, e.g. 1h] [reason]")
+}
+
+// OnUnmuteCommand lets the provided user talk in the group again.
+// (/unmute @<username> [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnUnmuteCommand(bot *telegram.Bot, message *telegram.Message) {
+	onModerationCommand(bot, message, database.ActionUnmute, "/unmute @<username> [reason]")
+}
+
+// onModerationCommand handles /ban, /unban, /kick, /mute and /unmute.
+func onModerationCommand(bot *telegram.Bot, message *telegram.Message, action database.ModerationAction, usage string) {
+	log.Printf(
+		"%v (%v) is attempting to %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, action,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	user, args := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateModerationCommand(bot, message, usage) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	if action == database.ActionUnmute && !mutedByCommand(user, message.Chat) {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"%v is muted until they answer the challenge or are approved! Please /approve or /reject them instead.",
+				helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+			),
+			telegram.ModeHTML,
+		)
+		return
+	}
+
+	duration, reason := parseModerationArgs(action, args)
+	reply := moderateUser(bot, message.Chat, user, message.Sender, action, duration, reason)
+	bot.Reply(message, reply, telegram.ModeHTML)
+}
+
+// parseModerationArgs returns the duration (0 for good) and reason of a
+// moderation command, from the arguments following its target. Only bans
+// and mutes take a duration, which comes first.
+func parseModerationArgs(action database.ModerationAction, args []string) (time.Duration, string) {
+	var duration time.Duration
+	if len(args) > 0 && (action == database.ActionBan || action == database.ActionMute) {
+		parsed, err := helpers.ParseDuration(args[0])
+		if err == nil && parsed > 0 {
+			duration, args = parsed, args[1:]
+		}
+	}
+
+	reason := strings.Join(args, " ")
+	if reason == "" {
+		reason = fmt.Sprintf("%v by an admin", describeModerationAction(action))
+	}
+
+	return duration, reason
+}
+
+// mutedByCommand returns false if the user is kept muted in the group
+// because of their (strict) challenge or quarantine, rather than /mute.
+func mutedByCommand(user *telegram.User, group *telegram.Chat) bool {
+	return !database.ChallengeIsStrict(user, group) &&
+		database.GetMemberState(user, group) != database.MemberQuarantined
+}
+
+// moderateUser takes an action on a user in the group (which is undone after
+// the given duration, if it isn't 0), and records it in the moderation log.
+// by is who took it (may be nil, e.g. if the bot did).
+// Returns a description (in HTML) of what was done, to reply with.
+func moderateUser(
+	bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User,
+	action database.ModerationAction, duration time.Duration, reason string,
+) string {
+	mention := helpers.MentionHTML(user.ID, user.Username, user.FirstName)
+	_, federationBanned := database.GetFederationBanReason(user, group)
+	reply := ""
+
+	switch action {
+	case database.ActionBan:
+		database.PunishUser(bot, group, user, by, reason)
+		reply = fmt.Sprintf("OK!! %v was banned%v.", mention, describeModerationDuration(duration))
+		if database.GetFederation(group) != nil {
+			reply += " They were also banned from the rest of the federation."
+		}
+	case database.ActionUnban:
+		database.PardonUser(bot, group, user, by)
+		reply = fmt.Sprintf("OK!! %v was unbanned, and can join again. ▽・ω・▽", mention)
+		if federationBanned {
+			reply += " They were also unbanned from the rest of the federation."
+		}
+	case database.ActionKick:
+		kickUser(bot, group, user)
+		database.KickUser(user, group, by)
+		reply = fmt.Sprintf("OK!! %v was kicked (they can join again).", mention)
+	case database.ActionMute:
+		muteUser(bot, group, user, duration)
+		reply = fmt.Sprintf("OK!! %v was muted%v.", mention, describeModerationDuration(duration))
+	case database.ActionUnmute:
+		if mutedByCommand(user, group) {
+			unmuteUser(bot, group, user)
+		}
+		reply = fmt.Sprintf("OK!! %v can talk again. ▽・ω・▽", mention)
+	}
+
+	database.LogModerationAction(user, group, action, reason, duration, by)
+	log.Printf(
+		"%v (%v) was %v in %v (%v) for %v: %v\n",
+		user.Username, user.ID, describeModerationAction(action),
+		group.Username, group.ID, duration, reason,
+	)
+	return reply
+}
+
+// unmuteUser lifts every restriction on a user in the group.
+func unmuteUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	err := bot.Restrict(group, &telegram.ChatMember{User: user, Rights: telegram.NoRestrictions()})
+
+	if err != nil {
+		log.Printf(
+			"Could not unmute %v (%v) in %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+	}
+}
+
+// UndoExpiredModeration unbans and unmutes users (in every group) whose
+// timed ban or mute expired.
+func UndoExpiredModeration(bot *telegram.Bot) {
+	for _, expired := range database.GetExpiredModerationActions() {
+		group := &telegram.Chat{ID: expired.GroupID}
+		user := &telegram.User{ID: expired.UserID}
+
+		switch expired.Action {
+		case database.ActionBan:
+			moderateUser(bot, group, user, nil, database.ActionUnban, 0, "ban expired")
+		case database.ActionMute:
+			moderateUser(bot, group, user, nil, database.ActionUnmute, 0, "mute expired")
+		}
+	}
+}
+
+// OnModLogCommand lists the latest moderation actions taken in the group
+// (with /ban, /unban, /kick, /mute and /unmute), by whom and why.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnModLogCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is looking up the moderation log in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	bot.Reply(
+		message,
+		constructModerationLog(database.GetModerationLog(message.Chat, ModerationLogLength)),
+		telegram.ModeHTML,
+	)
+}
+
+// constructModerationLog lists (in HTML) moderation actions, for /modlog.
+func constructModerationLog(entries []database.ModerationLogEntry) string {
+	if len(entries) == 0 {
+		return "Nobody was moderated here yet! ▽・ω・▽"
+	}
+
+	lines := []string{"<b>Latest moderation actions</b>"}
+	for _, entry := range entries {
+		line := fmt.Sprintf(
+			"%v: %v %v (by %v): %v",
+			formatMemberTime(entry.DoneOn), helpers.MentionHTML(entry.UserID, "", ""),
+			describeModerationAction(entry.Action), describeActor(entry.DoneBy, entry.UserID),
+			html.EscapeString(entry.Reason),
+		)
+		if !entry.ExpiresOn.IsZero() {
+			line += fmt.Sprintf(", until %v", formatMemberTime(entry.ExpiresOn))
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// describeModerationAction describes an action in the past tense (e.g. "banned").
+func describeModerationAction(action database.ModerationAction) string {
+	switch action {
+	case database.ActionKick:
+		return "kicked"
+	case database.ActionBan, database.ActionUnban:
+		return string(action) + "ned"
+	default:
+		return string(action) + "d"
+	}
+}
+
+// describeModerationDuration describes how long a ban or mute lasts
+// (e.g. " for 1h0m0s"), or returns an empty string if it's for good.
+func describeModerationDuration(duration time.Duration) string {
+	if duration <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" for %v", duration)
+}
+
+// validateModerationCommand returns true if all args are valid for a command
+// targeting any user in the group (e.g. /ban), returns false and replies with
+// a message explaining why (and the usage) if not
+func validateModerationCommand(bot *telegram.Bot, message *telegram.Message, usage string) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+	// Validate that the message returned a user
+	user, _ := parseTargetArgs(message)
+
+	if user == nil {
+		bot.Reply(
+			message,
+			fmt.Sprintf("Please send a username along with your command! (%v)", usage),
+		)
+		return false
+	}
+	if user.ID == 0 {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"I don't know who @%v is! Try replying to one of their messages, or using their ID.",
+				user.Username,
+			),
+		)
+		return false
+	}
+	// Validate that we aren't targeting an admin (or ourselves)
+	if user.ID == bot.Me.ID || isAdmin(bot, message.Chat, user) {
+		bot.Reply(message, "I can't do that to an admin!")
+		return false
+	}
+
+	return true
+}
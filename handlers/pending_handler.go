@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// PendingPageSize is the number of pending users listed per page of /pending.
+const PendingPageSize = 10
+
+// PendingApproveButton, PendingKickButton and PendingPageButton are the
+// inline buttons attached to the /pending list. Their callbacks need
+// to be registered in run.go.
+var (
+	PendingApproveButton = telegram.InlineButton{Unique: "pending_approve"}
+	PendingKickButton    = telegram.InlineButton{Unique: "pending_kick"}
+	PendingPageButton    = telegram.InlineButton{Unique: "pending_page"}
+)
+
+// OnPendingCommand lists the users currently being challenged in the group,
+// with buttons to approve or kick each of them.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnPendingCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is listing pending users in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	text, markup := constructPendingPage(message.Chat, 0)
+	bot.Reply(message, text, pendingOptions(markup)...)
+}
+
+// OnPendingApproveButton approves the user on a row of the /pending list.
+func OnPendingApproveButton(bot *telegram.Bot, callback *telegram.Callback) {
+	userID, page := parsePendingButtonData(callback.Data)
+	if !validatePendingButton(bot, callback, userID, page) {
+		return
+	}
+
+	user := &telegram.User{ID: userID}
+	approveUser(bot, callback.Message.Chat, user, callback.Sender)
+	log.Printf(
+		"%v (%v) approved %v from the pending list in %v (%v)",
+		callback.Sender.Username, callback.Sender.ID, userID,
+		callback.Message.Chat.Username, callback.Message.Chat.ID,
+	)
+
+	bot.Respond(callback, &telegram.CallbackResponse{Text: "Approved! ▽・ω・▽"})
+	refreshPendingPage(bot, callback, page)
+}
+
+// OnPendingKickButton kicks the user on a row of the /pending list.
+func OnPendingKickButton(bot *telegram.Bot, callback *telegram.Callback) {
+	userID, page := parsePendingButtonData(callback.Data)
+	if !validatePendingButton(bot, callback, userID, page) {
+		return
+	}
+
+	user := &telegram.User{ID: userID}
+	moderateUser(bot, callback.Message.Chat, user, callback.Sender, database.ActionKick, 0, "kicked from the pending list")
+	log.Printf(
+		"%v (%v) kicked %v from the pending list in %v (%v)",
+		callback.Sender.Username, callback.Sender.ID, userID,
+		callback.Message.Chat.Username, callback.Message.Chat.ID,
+	)
+
+	bot.Respond(callback, &telegram.CallbackResponse{Text: "Kicked!"})
+	refreshPendingPage(bot, callback, page)
+}
+
+// OnPendingPageButton shows another page of the /pending list.
+func OnPendingPageButton(bot *telegram.Bot, callback *telegram.Callback) {
+	if !validateAdminButton(bot, callback) {
+		return
+	}
+
+	page, _ := strconv.Atoi(callback.Data)
+	bot.Respond(callback)
+	refreshPendingPage(bot, callback, page)
+}
+
+// validateAdminButton returns true if an inline button was pressed by an
+// admin of the group the message is in. Responds with an alert if not.
+func validateAdminButton(bot *telegram.Bot, callback *telegram.Callback) bool {
+	if callback.Message == nil || callback.Sender == nil {
+		return false
+	}
+
+	if !isAdmin(bot, callback.Message.Chat, callback.Sender) {
+		log.Printf(
+			"%v (%v) pressed an admin button in %v (%v), but is not an admin",
+			callback.Sender.Username, callback.Sender.ID,
+			callback.Message.Chat.Username, callback.Message.Chat.ID,
+		)
+		bot.Respond(callback, &telegram.CallbackResponse{
+			Text:      "Only admins can do that!",
+			ShowAlert: true,
+		})
+		return false
+	}
+
+	return true
+}
+
+// validatePendingButton returns true if a /pending row button was pressed by
+// an admin and the user on that row is still being challenged.
+func validatePendingButton(bot *telegram.Bot, callback *telegram.Callback, userID int, page int) bool {
+	if !validateAdminButton(bot, callback) {
+		return false
+	}
+
+	if userID == 0 || database.GetMemberState(&telegram.User{ID: userID}, callback.Message.Chat) != database.MemberPending {
+		bot.Respond(callback, &telegram.CallbackResponse{Text: "This user is no longer pending."})
+		refreshPendingPage(bot, callback, page)
+		return false
+	}
+
+	return true
+}
+
+// refreshPendingPage replaces the /pending list the callback came from
+// with the given page.
+func refreshPendingPage(bot *telegram.Bot, callback *telegram.Callback, page int) {
+	text, markup := constructPendingPage(callback.Message.Chat, page)
+	bot.Edit(callback.Message, text, pendingOptions(markup)...)
+}
+
+// constructPendingPage returns the text and buttons for the given (0-indexed)
+// page of users currently being challenged in the group. There are no
+// buttons (nil) if nobody is being challenged.
+func constructPendingPage(group *telegram.Chat, page int) (string, *telegram.ReplyMarkup) {
+	total := database.CountChallengesForChat(group)
+	if total == 0 {
+		return "Nobody is waiting to be approved! ▽・ω・▽", nil
+	}
+
+	pages := (total + PendingPageSize - 1) / PendingPageSize
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	challenges := database.GetChallengesForChat(group, PendingPageSize, page*PendingPageSize)
+	lines := []string{fmt.Sprintf("<b>Pending users</b> (%v total, page %v/%v):", total, page+1, pages)}
+	var keyboard [][]telegram.InlineButton
+
+	for i, challenge := range challenges {
+		lines = append(lines, fmt.Sprintf(
+			"%v. %v, joined %v UTC, %v",
+			page*PendingPageSize+i+1,
+			helpers.MentionHTML(challenge.UserID, challenge.Username, challenge.DisplayName),
+			challenge.IssuedOn.Format("Jan 2 15:04"),
+			formatTimeLeft(challenge.ExpiresOn),
+		))
+
+		data := fmt.Sprintf("%v:%v", challenge.UserID, page)
+		approveButton, kickButton := PendingApproveButton, PendingKickButton
+		approveButton.Text = fmt.Sprintf("✅ Approve #%v", page*PendingPageSize+i+1)
+		approveButton.Data = data
+		kickButton.Text = fmt.Sprintf("❌ Kick #%v", page*PendingPageSize+i+1)
+		kickButton.Data = data
+		keyboard = append(keyboard, []telegram.InlineButton{approveButton, kickButton})
+	}
+
+	var navigation []telegram.InlineButton
+	if page > 0 {
+		previousButton := PendingPageButton
+		previousButton.Text = "« Previous"
+		previousButton.Data = strconv.Itoa(page - 1)
+		navigation = append(navigation, previousButton)
+	}
+	if page < pages-1 {
+		nextButton := PendingPageButton
+		nextButton.Text = "Next »"
+		nextButton.Data = strconv.Itoa(page + 1)
+		navigation = append(navigation, nextButton)
+	}
+	if len(navigation) > 0 {
+		keyboard = append(keyboard, navigation)
+	}
+
+	return strings.Join(lines, "\n"), &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// pendingOptions returns the send options for a /pending list.
+func pendingOptions(markup *telegram.ReplyMarkup) []interface{} {
+	options := []interface{}{telegram.ModeHTML, telegram.NoPreview}
+
+	if markup != nil {
+		options = append(options, markup)
+	}
+
+	return options
+}
+
+// formatTimeLeft describes how long until a challenge expires.
+func formatTimeLeft(expiresOn time.Time) string {
+	timeLeft := time.Until(expiresOn).Round(time.Second)
+
+	if timeLeft <= 0 {
+		return "expiring now"
+	}
+
+	return fmt.Sprintf("%v left", timeLeft)
+}
+
+// parsePendingButtonData returns the user ID and page number encoded
+// in the data of a /pending row button.
+func parsePendingButtonData(data string) (int, int) {
+	args := strings.SplitN(data, ":", 2)
+
+	if len(args) != 2 {
+		return 0, 0
+	}
+
+	userID, _ := strconv.Atoi(args[0])
+	page, _ := strconv.Atoi(args[1])
+	return userID, page
+}
+
+// kickUser removes the user from the group without banning them,
+// so they may rejoin later.
+func kickUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) {
+	err := bot.Ban(group, &telegram.ChatMember{User: user})
+
+	if err != nil {
+		log.Printf(
+			"Could not kick %v (%v) from %v (%v). Do we have admin permission there? %v\n",
+			user.Username, user.ID, group.Username, group.ID, err,
+		)
+		return
+	}
+
+	bot.Unban(group, user)
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"bigboofer/database"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnStartCommand handles a user opening a PM with the bot. If they came from
+// the "Verify me" button of a welcome message, the payload is the token of
+// their challenge, and they are asked to answer it here.
+func OnStartCommand(bot *telegram.Bot, message *telegram.Message) {
+	if !message.Private() {
+		return
+	}
+
+	if message.Payload == "" {
+		bot.Send(
+			message.Sender,
+			"Woof! I keep spambots out of groups. ▽・ω・▽ "+
+				"Add me to your group and promote me to admin to get started!",
+		)
+		return
+	}
+
+	groupID, userID := database.GetChallengeForToken(message.Payload)
+	if groupID == 0 && message.Payload == LockdownStartPayload {
+		groups := database.GetChallengedGroupsForUser(message.Sender)
+		if len(groups) > 0 {
+			log.Printf(
+				"%v (%v) started verifying in a PM from a lockdown welcome",
+				message.Sender.Username, message.Sender.ID,
+			)
+			bot.Send(
+				message.Sender,
+				fmt.Sprintf(
+					"Hello! To chat in the group, please read %v and reply here "+
+						"with the passphrase written in the channel. ▽・ω・▽",
+					database.GetAuthChannel(&groups[0]),
+				),
+			)
+			return
+		}
+	}
+	if groupID == 0 {
+		bot.Send(message.Sender, "That link has expired, or you were already approved! ▽・ω・▽")
+		return
+	}
+	if userID != message.Sender.ID {
+		log.Printf(
+			"%v (%v) opened the verification link of %v in %v",
+			message.Sender.Username, message.Sender.ID, userID, groupID,
+		)
+		bot.Send(message.Sender, "That link is for someone else! Please use the one in your own welcome message.")
+		return
+	}
+
+	group := &telegram.Chat{ID: groupID}
+	groupTitle := "the group"
+	if groupChat, err := bot.ChatByID(strconv.FormatInt(groupID, 10)); err == nil {
+		groupTitle = groupChat.Title
+	}
+
+	log.Printf(
+		"%v (%v) started verifying in a PM for %v",
+		message.Sender.Username, message.Sender.ID, groupID,
+	)
+	bot.Send(
+		message.Sender,
+		fmt.Sprintf(
+			"Hello! To chat in %v, please read %v and reply here "+
+				"with the passphrase written in the channel. ▽・ω・▽",
+			groupTitle, database.GetAuthChannel(group),
+		),
+	)
+}
+
+// onPrivateMessage checks a PM sent to the bot against the passphrases of
+// every group the sender is being challenged in, and vets them in each group
+// it matches.
+func onPrivateMessage(bot *telegram.Bot, message *telegram.Message) {
+	if message.Text == "" || strings.HasPrefix(message.Text, "/") {
+		return
+	}
+
+	groups := database.GetChallengedGroupsForUser(message.Sender)
+	if len(groups) == 0 {
+		return
+	}
+
+	passed := false
+	for _, group := range groups {
+		if database.CheckPassphrase(&group, message.Text) {
+			passChallenge(bot, &group, message.Sender)
+			passed = true
+		}
+	}
+
+	if !passed {
+		bot.Send(message.Sender, "That's not it! Please check the channel again. ▽・ω・▽")
+		return
+	}
+
+	bot.Send(message.Sender, "Woof!! Thanks! You are free to chat as you wish. ▽ - ω - ▽")
+}
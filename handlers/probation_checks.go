@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// ProbationContentLength is how much of a message sent on probation
+// is kept for admins to review.
+const ProbationContentLength = 200
+
+// probationRestriction is something members on probation may be kept from
+// sending, if the group setting of the same name is on.
+type probationRestriction struct {
+	Setting string
+	Name    string
+	Matches func(message *telegram.Message) bool
+}
+
+// probationRestrictions are everything members on probation may be kept from sending.
+var probationRestrictions = []probationRestriction{
+	{"probation_block_links", "links", messageHasLink},
+	{"probation_block_forwards", "forwarded messages", func(message *telegram.Message) bool {
+		return message.IsForwarded() || message.OriginalUnixtime != 0
+	}},
+	{"probation_block_media", "media", func(message *telegram.Message) bool {
+		return messageMedia(message) != ""
+	}},
+	{"probation_block_mentions", "mentions", func(message *telegram.Message) bool {
+		return messageHasEntity(message, telegram.EntityMention, telegram.EntityTMention)
+	}},
+}
+
+// probationEnds returns when a member's probation in the group ends, and true
+// if they are on probation: they answered the challenge (or were approved)
+// within the group's probation_period.
+func probationEnds(group *telegram.Chat, member database.Member) (time.Time, bool) {
+	period := settingDuration(group, "probation_period")
+	if period <= 0 || member.State != database.MemberVerified || member.VerifiedOn.IsZero() {
+		return time.Time{}, false
+	}
+
+	ends := member.VerifiedOn.Add(period)
+	return ends, time.Now().Before(ends)
+}
+
+// enforceProbation keeps a message sent by a member on probation for admins to
+// review (up to probation_logged_messages of them), and deletes it if it contains
+// something they may not send yet (see probationRestrictions). The member is told
+// why privately, and warned if the group's probation_warnings setting is on.
+// Admins are never on probation. Returns true if it was deleted.
+func enforceProbation(bot *telegram.Bot, message *telegram.Message, member database.Member) bool {
+	group := message.Chat
+	ends, onProbation := probationEnds(group, member)
+	if !onProbation {
+		return false
+	}
+
+	admins := cachedAdminsOf(bot, group)
+	if helpers.ChatMemberContains(&admins, message.Sender) {
+		return false
+	}
+
+	blocked := ""
+	for _, restriction := range probationRestrictions {
+		if settingEnabled(group, restriction.Setting) && restriction.Matches(message) {
+			blocked = restriction.Name
+			break
+		}
+	}
+
+	database.LogProbationMessage(
+		message.Sender, group, message.ID, describeMessage(message), blocked,
+		settingInt(group, "probation_logged_messages"),
+	)
+	if blocked == "" {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) is on probation in %v (%v) and sent %v, deleting.\n",
+		message.Sender.Username, message.Sender.ID, group.Username, group.ID, blocked,
+	)
+	err := bot.Delete(message)
+	if err != nil {
+		log.Printf(
+			"Could not delete message sent by %v (%v) on probation in %v (%v). Do we have admin permission there? %v\n",
+			message.Sender.Username, message.Sender.ID, group.Username, group.ID, err,
+		)
+	}
+
+	bot.Send(
+		message.Sender,
+		fmt.Sprintf(
+			"Welcome to %v! New members can't send %v there yet, so I removed your "+
+				"message. You can from %v. ▽・ω・▽",
+			html.EscapeString(groupName(group)), blocked, ends.Format("Jan 2 15:04 UTC"),
+		),
+		telegram.ModeHTML,
+	)
+
+	if settingEnabled(group, "probation_warnings") {
+		bot.Send(
+			group, warnUser(bot, group, message.Sender, nil, "sent "+blocked+" while on probation"),
+			telegram.ModeHTML,
+		)
+	}
+	return true
+}
+
+// constructProbationReport describes (in HTML) a member's probation in the group
+// and the messages kept from it, for /member. Returns an empty string if they
+// aren't on probation and no messages were kept.
+func constructProbationReport(user *telegram.User, group *telegram.Chat, member database.Member) string {
+	var lines []string
+
+	if ends, onProbation := probationEnds(group, member); onProbation {
+		lines = append(lines, "On probation until "+formatMemberTime(ends))
+	}
+
+	messages := database.GetProbationMessages(user, group)
+	if len(messages) > 0 {
+		lines = append(lines, "<b>First messages</b>")
+	}
+	for _, message := range messages {
+		line := fmt.Sprintf(
+			"%v: %v", message.SentOn.Format("Jan 2 15:04"), html.EscapeString(message.Content),
+		)
+		if message.Blocked != "" {
+			line += fmt.Sprintf(" (deleted: %v)", message.Blocked)
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// describeMessage describes a message for admins to review, e.g.
+// "[photo] caption", shortened to ProbationContentLength characters.
+func describeMessage(message *telegram.Message) string {
+	content := messageText(message)
+
+	if media := messageMedia(message); media != "" {
+		content = strings.TrimSpace(fmt.Sprintf("[%v] %v", media, content))
+	}
+	if message.IsForwarded() || message.OriginalUnixtime != 0 {
+		content = "[forwarded] " + content
+	}
+
+	if utf8.RuneCountInString(content) > ProbationContentLength {
+		content = string([]rune(content)[:ProbationContentLength]) + "…"
+	}
+
+	return content
+}
+
+// messageHasLink returns true if the text or caption of a message contains a link.
+func messageHasLink(message *telegram.Message) bool {
+	return messageHasEntity(message, telegram.EntityURL, telegram.EntityTextLink) ||
+		helpers.ContainsURL(messageText(message))
+}
+
+// messageHasEntity returns true if the text or caption of a message
+// contains an entity of any of the given types.
+func messageHasEntity(message *telegram.Message, types ...telegram.EntityType) bool {
+	for _, entity := range messageEntities(message) {
+		for _, entityType := range types {
+			if entity.Type == entityType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
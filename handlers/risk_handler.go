@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// RiskReportLength is the number of recent newcomers listed by /risk.
+const RiskReportLength = 10
+
+// riskSignal is something about a newcomer's profile that makes them more
+// likely to be a spammer. Check returns true if the user shows the signal,
+// in which case its Weight is added to their risk score.
+type riskSignal struct {
+	Name   string
+	Weight int
+	Check  func(bot *telegram.Bot, user *telegram.User) bool
+}
+
+// cryptoKeywords are words spammers like to put in their names.
+var cryptoKeywords = []string{
+	"crypto", "bitcoin", "btc", "usdt", "ethereum", "nft", "airdrop",
+	"forex", "binance", "invest", "trading", "giveaway", "profit",
+}
+
+// riskSignals are every signal newcomers are scored on when they join.
+// To score another signal, add it here.
+var riskSignals = []riskSignal{
+	{"name_has_link", 50, func(bot *telegram.Bot, user *telegram.User) bool {
+		return helpers.ContainsURL(user.FirstName + " " + user.LastName)
+	}},
+	{"name_has_crypto_words", 40, func(bot *telegram.Bot, user *telegram.User) bool {
+		return helpers.ContainsAnyWord(user.FirstName+" "+user.LastName+" "+user.Username, cryptoKeywords)
+	}},
+	{"name_is_stuffed", 25, func(bot *telegram.Bot, user *telegram.User) bool {
+		name := user.FirstName + " " + user.LastName
+		return helpers.HasBidiControls(name) || helpers.CountEmoji(name) >= 3
+	}},
+	{"no_username", 10, func(bot *telegram.Bot, user *telegram.User) bool {
+		return user.Username == ""
+	}},
+	{"no_profile_photo", 15, func(bot *telegram.Bot, user *telegram.User) bool {
+		photos, err := bot.ProfilePhotosOf(user)
+		if err != nil {
+			log.Printf("Could not get profile photos of %v (%v)!! %v\n", user.Username, user.ID, err)
+			return false
+		}
+
+		return len(photos) == 0
+	}},
+}
+
+// scoreRisk returns the risk score of a user (the sum of the weights of every
+// signal they show), and the names of those signals.
+func scoreRisk(bot *telegram.Bot, user *telegram.User) (int, []string) {
+	score := 0
+	var signals []string
+
+	for _, signal := range riskSignals {
+		if signal.Check(bot, user) {
+			score += signal.Weight
+			signals = append(signals, signal.Name)
+		}
+	}
+
+	return score, signals
+}
+
+// screenByRisk scores a new user's profile (if the group's risk_scoring setting
+// is on), records the score, and bans or exempts them if it is high or low enough
+// according to the group's risk_ban_at and risk_approve_below settings.
+// Returns what to do with them, which is database.RiskChallenged if they weren't scored.
+func screenByRisk(bot *telegram.Bot, group *telegram.Chat, user *telegram.User) database.RiskOutcome {
+	if !settingEnabled(group, "risk_scoring") {
+		return database.RiskChallenged
+	}
+
+	score, signals := scoreRisk(bot, user)
+	banAt := settingInt(group, "risk_ban_at")
+	strictAt := settingInt(group, "risk_strict_at")
+
+	var outcome database.RiskOutcome
+	switch {
+	case banAt > 0 && score >= banAt:
+		outcome = database.RiskBanned
+	case score < settingInt(group, "risk_approve_below"):
+		outcome = database.RiskApproved
+	case strictAt > 0 && score >= strictAt:
+		outcome = database.RiskStrictChallenged
+	default:
+		outcome = database.RiskChallenged
+	}
+
+	log.Printf(
+		"%v (%v) joined %v (%v) with a risk score of %v (%v), %v.\n",
+		user.Username, user.ID, group.Username, group.ID,
+		score, strings.Join(signals, ", "), outcome,
+	)
+	database.RecordRiskScore(user, group, score, signals, outcome)
+
+	switch outcome {
+	case database.RiskBanned:
+		// Only a guess, so not shared with the federation
+		database.BanUserLocally(bot, group, user, nil)
+		database.LogModerationAction(user, group, database.ActionBan, describeRisk(score, signals), 0, nil)
+	case database.RiskApproved:
+		database.ExemptUser(user, group, nil)
+	}
+
+	return outcome
+}
+
+// OnRiskCommand lists the risk scores of the latest newcomers to the group,
+// the signals that contributed to them, and what was done with them.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnRiskCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is listing risk scores in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	scores := database.GetRiskScores(message.Chat, RiskReportLength)
+	if len(scores) == 0 {
+		bot.Reply(message, "I haven't scored anyone who joined here yet! ▽・ω・▽")
+		return
+	}
+
+	lines := []string{"<b>Latest newcomers' risk scores</b>"}
+	for _, risk := range scores {
+		lines = append(lines, fmt.Sprintf(
+			"%v: %v, %v (%v)",
+			helpers.MentionHTML(risk.UserID, risk.Username, ""),
+			describeRisk(risk.Score, risk.Signals), risk.Outcome,
+			formatMemberTime(risk.ScoredOn),
+		))
+	}
+
+	bot.Reply(message, strings.Join(lines, "\n"), telegram.ModeHTML)
+}
+
+// describeRisk describes a risk score and the signals that contributed to it.
+func describeRisk(score int, signals []string) string {
+	if len(signals) == 0 {
+		return fmt.Sprintf("risk score %v", score)
+	}
+
+	return fmt.Sprintf("risk score %v (%v)", score, strings.Join(signals, ", "))
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigboofer/classifier"
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnSpamCommand teaches the group's spam classifier that the message being
+// replied to (or that looked like spam and has the given number) is spam,
+// and deletes it. (/spam [number])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnSpamCommand(bot *telegram.Bot, message *telegram.Message) {
+	onTrainCommand(bot, message, true)
+}
+
+// OnHamCommand teaches the group's spam classifier that the message being
+// replied to (or that looked like spam and has the given number) isn't spam.
+// (/ham [number])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnHamCommand(bot *telegram.Bot, message *telegram.Message) {
+	onTrainCommand(bot, message, false)
+}
+
+// onTrainCommand handles /spam and /ham.
+func onTrainCommand(bot *telegram.Bot, message *telegram.Message, spam bool) {
+	command := "/ham"
+	if spam {
+		command = "/spam"
+	}
+
+	log.Printf(
+		"%v (%v) is attempting to run %v %v in %v (%v)",
+		message.Sender.Username, message.Sender.ID, command, message.Payload,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateTrainCommand(bot, message, command) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	messageID, text := parseTrainArgs(message)
+	learned := classifier.Train(message.Chat, messageID, text, spam)
+	database.SetSpamVerdict(message.Chat, messageID, spam)
+	log.Printf(
+		"%v (%v) marked message %v in %v (%v) as spam: %v",
+		message.Sender.Username, message.Sender.ID, messageID,
+		message.Chat.Username, message.Chat.ID, spam,
+	)
+
+	response := "OK!! I'll remember that kind of message isn't spam. ▽・ω・▽"
+	if spam {
+		response = "OK!! I'll remember that kind of message is spam. ▽・ω・▽"
+	}
+	if !learned {
+		response = "I already knew that one! ▽・ω・▽"
+	}
+
+	// Clean up spam (and the command, since it can't be a reply anymore)
+	if spam && message.ReplyTo != nil {
+		bot.Delete(message.ReplyTo)
+		bot.Delete(message)
+		bot.Send(message.Chat, response)
+		return
+	}
+
+	bot.Reply(message, response)
+}
+
+// validateTrainCommand returns true if all args are valid for /spam or /ham,
+// returns false and replies with a message explaining why if not
+func validateTrainCommand(bot *telegram.Bot, message *telegram.Message, command string) bool {
+	if !validateAdminCommand(bot, message) {
+		return false
+	}
+
+	if messageID, text := parseTrainArgs(message); messageID == 0 || len(classifier.Tokenize(text)) == 0 {
+		bot.Reply(
+			message,
+			fmt.Sprintf(
+				"Please reply to a message with words in it, or send the number of a message "+
+					"I told you about! (%v [number])", command,
+			),
+		)
+		return false
+	}
+
+	return true
+}
+
+// parseTrainArgs returns the ID and text of the message a /spam or /ham
+// command is about: the message being replied to, or the message that looked
+// like spam with the given number. Returns 0 if there isn't one.
+func parseTrainArgs(message *telegram.Message) (int, string) {
+	if message.ReplyTo != nil {
+		return message.ReplyTo.ID, messageText(message.ReplyTo)
+	}
+
+	messageID, err := strconv.Atoi(strings.TrimSpace(message.Payload))
+	if err != nil {
+		return 0, ""
+	}
+
+	prediction, found := database.GetSpamPrediction(message.Chat, messageID)
+	if !found {
+		return 0, ""
+	}
+
+	return messageID, prediction.Content
+}
+
+// OnSpamStatsCommand shows how well trained the group's spam classifier is,
+// what it did, and how often admins agreed.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnSpamStatsCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is looking up spam stats in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	bot.Reply(message, constructSpamStats(message.Chat), telegram.ModeHTML)
+}
+
+// constructSpamStats describes (in HTML) the group's spam classifier, for /spamstats.
+func constructSpamStats(group *telegram.Chat) string {
+	trained := database.GetSpamTrainingCounts(group)
+	stats := database.GetSpamStats(group)
+
+	lines := []string{
+		"<b>Spam classifier</b>",
+		fmt.Sprintf("Trained with: %v spam and %v ham messages", trained.Spam, trained.Ham),
+	}
+
+	if trained.Spam < classifier.MinTrainingMessages || trained.Ham < classifier.MinTrainingMessages {
+		lines = append(lines, fmt.Sprintf(
+			"I need at least %v of each before checking messages. "+
+				"Reply /spam or /ham to messages to teach me!",
+			classifier.MinTrainingMessages,
+		))
+	}
+
+	lines = append(lines, fmt.Sprintf("Looked like spam: %v deleted, %v flagged", stats.Deleted, stats.Flagged))
+
+	reviewed := stats.ConfirmedSpam + stats.ConfirmedHam
+	if reviewed == 0 {
+		lines = append(lines, "Precision: unknown (admins haven't reviewed any of them yet)")
+	} else {
+		lines = append(lines, fmt.Sprintf(
+			"Precision: %.0f%% (%v of the %v reviewed by admins were spam)",
+			100*float64(stats.ConfirmedSpam)/float64(reviewed), stats.ConfirmedSpam, reviewed,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// checkSpam classifies a message sent by a recent member of the group (see
+// spam_recent_member_period) with the group's spam classifier, if its
+// spam_classifier setting is on. Likely spam is deleted or flagged to admins
+// according to the spam_delete_at and spam_flag_at settings. Admins are never
+// checked. Returns true if it was deleted.
+func checkSpam(bot *telegram.Bot, message *telegram.Message, member database.Member) bool {
+	group := message.Chat
+	text := messageText(message)
+	if text == "" || !settingEnabled(group, "spam_classifier") || !isRecentMember(group, member) {
+		return false
+	}
+
+	probability, ready := classifier.SpamProbability(group, text)
+	if !ready {
+		return false
+	}
+
+	percent := int(probability * 100)
+	deleteAt, flagAt := settingInt(group, "spam_delete_at"), settingInt(group, "spam_flag_at")
+	action := ""
+	switch {
+	case deleteAt > 0 && percent >= deleteAt:
+		action = database.SpamDeleted
+	case flagAt > 0 && percent >= flagAt:
+		action = database.SpamFlagged
+	default:
+		return false
+	}
+
+	admins := cachedAdminsOf(bot, group)
+	if helpers.ChatMemberContains(&admins, message.Sender) {
+		return false
+	}
+
+	log.Printf(
+		"%v (%v) sent a message that is %v%% likely to be spam in %v (%v), %v.\n",
+		message.Sender.Username, message.Sender.ID, percent, group.Username, group.ID, action,
+	)
+	database.RecordSpamPrediction(group, message, text, probability, action)
+
+	sender := helpers.MentionHTML(message.Sender.ID, message.Sender.Username, message.Sender.FirstName)
+	quote := html.EscapeString(describeMessage(message))
+
+	if action == database.SpamFlagged {
+		where := html.EscapeString(groupName(group))
+		if link := messageLink(message); link != "" {
+			where = fmt.Sprintf(`<a href="%v">%v</a>`, link, where)
+		}
+
+		notifyAdmins(bot, group, fmt.Sprintf(
+			"🤔 %v sent a message in %v that is %v%% likely to be spam:\n<i>%v</i>\n"+
+				"Please reply /spam or /ham to it, or run /spam %v or /ham %v there.",
+			sender, where, percent, quote, message.ID, message.ID,
+		))
+		return false
+	}
+
+	err := bot.Delete(message)
+	if err != nil {
+		log.Printf(
+			"Could not delete message sent by %v (%v) in %v (%v). Do we have admin permission there? %v\n",
+			message.Sender.Username, message.Sender.ID, group.Username, group.ID, err,
+		)
+	}
+
+	notifyAdmins(bot, group, fmt.Sprintf(
+		"🗑️ I deleted a message %v sent in %v, which was %v%% likely to be spam:\n<i>%v</i>\n"+
+			"If it wasn't, please run /ham %v there.",
+		sender, html.EscapeString(groupName(group)), percent, quote, message.ID,
+	))
+	return true
+}
+
+// isRecentMember returns true if the member joined the group (or was
+// exempted from the challenge) within spam_recent_member_period.
+func isRecentMember(group *telegram.Chat, member database.Member) bool {
+	joinedOn := member.JoinedOn
+	if joinedOn.IsZero() {
+		joinedOn = member.VerifiedOn
+	}
+
+	return !joinedOn.IsZero() && time.Since(joinedOn) < settingDuration(group, "spam_recent_member_period")
+}
+
+// messageLink returns a link to a message in a group (which only works for
+// supergroups), or an empty string if there isn't one.
+func messageLink(message *telegram.Message) string {
+	if message.Chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%v/%v", message.Chat.Username, message.ID)
+	}
+
+	id := strconv.FormatInt(-message.Chat.ID, 10)
+	if !strings.HasPrefix(id, "100") {
+		return ""
+	}
+
+	return fmt.Sprintf("https://t.me/c/%v/%v", strings.TrimPrefix(id, "100"), message.ID)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnStatusCommand replies with the configuration of the group, and checks that
+// the bot has all the permissions it needs to enforce challenges there.
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnStatusCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is requesting status for %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	// Validate metadata and contents
+	if !validateAdminCommand(bot, message) {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	problems := diagnosePermissions(bot, message.Chat)
+	problems = append(problems, diagnoseAuthChannel(bot, message.Chat)...)
+
+	lines := []string{
+		"<b>Configuration</b>",
+		fmt.Sprintf(
+			"Challenge: passphrase from %v %v",
+			html.EscapeString(database.GetAuthChannelTitle(message.Chat)),
+			html.EscapeString(orNone(database.GetAuthChannel(message.Chat))),
+		),
+		fmt.Sprintf("Passphrase synced from pinned message: %v", database.UsesPinnedPassphrase(message.Chat)),
+		"Timeout: " + describeTimeout(message.Chat),
+		"Punishment: " + describePunishment(message.Chat),
+		fmt.Sprintf("Pending users: %v", database.CountChallengesForChat(message.Chat)),
+		"Lockdown: " + describeLockdown(message.Chat),
+		"Members I've seen join: " + describeMemberCounts(database.CountMembersByState(message.Chat)),
+		"",
+	}
+
+	if len(problems) == 0 {
+		lines = append(lines, "Everything looks good! ▽・ω・▽")
+	} else {
+		lines = append(lines, "<b>Problems</b>")
+		for _, problem := range problems {
+			lines = append(lines, "⚠️ "+problem)
+		}
+	}
+
+	bot.Reply(message, strings.Join(lines, "\n"), telegram.ModeHTML, telegram.NoPreview)
+}
+
+// describeTimeout describes how long newcomers to the group currently have
+// to answer the challenge: lockdown_timeout during a lockdown, and otherwise
+// the usual timeout, or lockdown_timeout for those with a high risk score.
+func describeTimeout(group *telegram.Chat) string {
+	strictTimeout := settingDuration(group, "lockdown_timeout")
+	if inLockdown(group) {
+		return fmt.Sprintf("%v (lockdown, muted until they answer)", strictTimeout)
+	}
+
+	timeout := database.ChallengeTimeout().String()
+	if strictAt := settingInt(group, "risk_strict_at"); settingEnabled(group, "risk_scoring") && strictAt > 0 {
+		timeout += fmt.Sprintf(
+			", or %v for risk scores of %v or more (muted until they answer)",
+			strictTimeout, strictAt,
+		)
+	}
+
+	return timeout
+}
+
+// describePunishment describes what happens to users who don't answer the
+// challenge in time in the group (see database.ChallengePunishmentSetting).
+func describePunishment(group *telegram.Chat) string {
+	punishment := getSetting(group, database.ChallengePunishmentSetting)
+	if punishment == string(database.ActionBan) && database.GetFederation(group) != nil {
+		return punishment + " (from the whole federation)"
+	}
+
+	return punishment
+}
+
+// describeMemberCounts describes how many members are in each state,
+// e.g. "12 verified, 3 exempt".
+func describeMemberCounts(counts map[database.MemberState]int) string {
+	var parts []string
+
+	for _, state := range []database.MemberState{
+		database.MemberPending, database.MemberVerified, database.MemberExempt,
+		database.MemberQuarantined, database.MemberFailed, database.MemberBanned,
+		database.MemberKicked, database.MemberUnbanned,
+	} {
+		if counts[state] > 0 {
+			parts = append(parts, fmt.Sprintf("%v %v", counts[state], state))
+		}
+	}
+
+	return orNone(strings.Join(parts, ", "))
+}
+
+// diagnosePermissions returns a list of problems (and how to fix them) with
+// the permissions the bot has in the group.
+func diagnosePermissions(bot *telegram.Bot, group *telegram.Chat) []string {
+	member, err := bot.ChatMemberOf(group, bot.Me)
+
+	if err != nil {
+		log.Printf(
+			"Could not look up our own permissions in %v (%v)!! %v\n",
+			group.Username, group.ID, err,
+		)
+		return []string{"I couldn't look up my own permissions here. Please try again later."}
+	}
+
+	if member.Role == telegram.Creator {
+		return nil
+	}
+	if member.Role != telegram.Administrator {
+		return []string{
+			"I'm not an admin here, so I can't delete messages or remove anyone. " +
+				"Please promote me to admin!",
+		}
+	}
+
+	var problems []string
+	if !member.CanDeleteMessages {
+		problems = append(problems,
+			"I can't delete messages, so new users can chat before answering. "+
+				"Please give me the \"Delete messages\" permission.")
+	}
+	if !member.CanRestrictMembers {
+		problems = append(problems,
+			"I can't ban or restrict users, so I can't remove anyone who doesn't answer. "+
+				"Please give me the \"Ban users\" permission.")
+	}
+
+	return problems
+}
+
+// diagnoseAuthChannel returns a list of problems (and how to fix them) with
+// the channel containing the passphrase for the group.
+func diagnoseAuthChannel(bot *telegram.Bot, group *telegram.Chat) []string {
+	channelURL := database.GetAuthChannel(group)
+
+	if channelURL == "" {
+		return []string{
+			"No channel is set, so I'm not challenging anyone. " +
+				"Please run /setchannel &lt;channel_url&gt; &lt;passphrase&gt;.",
+		}
+	}
+
+	channel, err := resolveAuthChannel(bot, channelURL)
+	if err != nil {
+		log.Printf(
+			"Could not resolve auth channel %v for %v (%v)!! %v\n",
+			channelURL, group.Username, group.ID, err,
+		)
+		return []string{fmt.Sprintf(
+			"I can't find the channel %v (%v). Is it public, and is the name spelled right? "+
+				"Please run /setchannel again.",
+			html.EscapeString(channelURL), html.EscapeString(err.Error()),
+		)}
+	}
+
+	if database.UsesPinnedPassphrase(group) && !canReadChannel(bot, channel) {
+		return []string{
+			"I can't read the channel anymore, so the passphrase won't follow its pinned " +
+				"message. Please add me back to the channel as an admin.",
+		}
+	}
+
+	return nil
+}
+
+// orNone returns the value, or "(none)" if it is empty.
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+
+	return value
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"bigboofer/database"
+	"bigboofer/helpers"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// OnWarnCommand warns the provided user, who is muted or banned if they were
+// warned too often (see warnUser). (/warn @<username> [reason])
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnWarnCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to warn in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	user, args := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateModerationCommand(bot, message, "/warn @<username> [reason]") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	reason := strings.Join(args, " ")
+	if reason == "" {
+		reason = "warned by an admin"
+	}
+
+	bot.Reply(message, warnUser(bot, message.Chat, user, message.Sender, reason), telegram.ModeHTML)
+}
+
+// OnWarnsCommand lists the warnings the provided user was given in the group.
+// (/warns @<username>)
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnWarnsCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is listing warnings in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	user, _ := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateModerationCommand(bot, message, "/warns @<username>") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	bot.Reply(message, constructWarningList(user, database.GetWarnings(user, message.Chat)), telegram.ModeHTML)
+}
+
+// OnUnwarnCommand removes the latest warning the provided user was given in
+// the group. (/unwarn @<username>)
+// Checks that the user who sent the command is an admin of the group they sent it in.
+func OnUnwarnCommand(bot *telegram.Bot, message *telegram.Message) {
+	log.Printf(
+		"%v (%v) is attempting to unwarn in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+
+	user, _ := parseTargetArgs(message)
+
+	// Validate metadata and contents
+	if !validateModerationCommand(bot, message, "/unwarn @<username>") {
+		log.Printf(
+			"%v (%v) failed validation for %v (%v)",
+			message.Sender.Username, message.Sender.ID,
+			message.Chat.Username, message.Chat.ID,
+		)
+		return
+	}
+
+	mention := helpers.MentionHTML(user.ID, user.Username, user.FirstName)
+	if !database.RemoveLatestWarning(user, message.Chat) {
+		bot.Reply(message, fmt.Sprintf("%v has no warnings here!", mention), telegram.ModeHTML)
+		return
+	}
+
+	log.Printf(
+		"%v (%v) removed the latest warning of %v (%v) in %v (%v)",
+		message.Sender.Username, message.Sender.ID,
+		user.Username, user.ID,
+		message.Chat.Username, message.Chat.ID,
+	)
+	bot.Reply(
+		message,
+		fmt.Sprintf("OK!! Removed the latest warning of %v. ▽・ω・▽", mention),
+		telegram.ModeHTML,
+	)
+}
+
+// warnUser warns a user in the group. If they now have warn_ban_at warnings
+// within warn_window, they are banned from the group (not from the rest of its
+// federation), or if they have warn_mute_at, muted for
+// warn_mute_duration (by the bot, see moderateUser). by is who warned them
+// (may be nil, e.g. for filters).
+// Returns the announcement (in HTML) to send in the group.
+func warnUser(bot *telegram.Bot, group *telegram.Chat, user *telegram.User, by *telegram.User, reason string) string {
+	database.AddWarning(user, group, reason, by)
+	count := database.CountWarningsWithin(user, group, settingDuration(group, "warn_window"))
+	log.Printf(
+		"%v (%v) was warned in %v (%v), %v so far: %v\n",
+		user.Username, user.ID, group.Username, group.ID, count, reason,
+	)
+
+	announcement := fmt.Sprintf(
+		"⚠️ %v, you were warned: %v. (%v so far)",
+		helpers.MentionHTML(user.ID, user.Username, user.FirstName),
+		html.EscapeString(reason), count,
+	)
+
+	banAt, muteAt := settingInt(group, "warn_ban_at"), settingInt(group, "warn_mute_at")
+	switch {
+	case banAt > 0 && count >= banAt:
+		// Automatic, so not shared with the federation
+		database.BanUserLocally(bot, group, user, nil)
+		database.LogModerationAction(user, group, database.ActionBan, fmt.Sprintf("warned %v times", count), 0, nil)
+		announcement += " That's too many, so you were banned."
+	case muteAt > 0 && count >= muteAt:
+		duration := settingDuration(group, "warn_mute_duration")
+		moderateUser(bot, group, user, nil, database.ActionMute, duration, fmt.Sprintf("warned %v times", count))
+		announcement += fmt.Sprintf(" That's too many, so you were muted for %v.", duration)
+	}
+
+	return announcement
+}
+
+// constructWarningList lists (in HTML) the warnings a user was given, for /warns.
+func constructWarningList(user *telegram.User, warnings []database.Warning) string {
+	mention := helpers.MentionHTML(user.ID, user.Username, user.FirstName)
+	if len(warnings) == 0 {
+		return fmt.Sprintf("%v has no warnings here! ▽・ω・▽", mention)
+	}
+
+	lines := []string{fmt.Sprintf("<b>Warnings of %v</b>", mention)}
+	for _, warning := range warnings {
+		lines = append(lines, fmt.Sprintf(
+			"%v: %v (by %v)",
+			formatMemberTime(warning.WarnedOn), html.EscapeString(warning.Reason),
+			describeActor(warning.WarnedBy, user.ID),
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -1,8 +1,16 @@
 package helpers
 
 import (
+	"fmt"
+	"html"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
 
 	telegram "gopkg.in/tucnak/telebot.v2"
 )
@@ -24,10 +32,311 @@ func GetRelativeProjPath(pathComponents ...string) string {
 // ChatMemberContains returns true if the ChatMember list contains the User.
 func ChatMemberContains(list *[]telegram.ChatMember, user *telegram.User) bool {
 	for _, listUser := range *list {
-		if *user == *listUser.User {
+		// Only compare IDs, since the same user may be returned
+		// with different optional fields (e.g. language_code)
+		if listUser.User != nil && user.ID == listUser.User.ID {
 			return true
 		}
 	}
 
 	return false
 }
+
+// DisplayName returns the name a user would be shown with
+// (their @username if they have one).
+func DisplayName(user *telegram.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// MentionHTML returns an HTML link mentioning a user, which works even if
+// they have no username. Send it with telegram.ModeHTML.
+func MentionHTML(userID int, username string, displayName string) string {
+	label := displayName
+
+	if username != "" {
+		label = "@" + username
+	}
+	if label == "" {
+		label = fmt.Sprintf("user %v", userID)
+	}
+
+	return fmt.Sprintf(
+		`<a href="tg://user?id=%v">%v</a>`,
+		userID, html.EscapeString(label),
+	)
+}
+
+// MessageHTML returns the text of a message as HTML, with its mentions, links
+// and formatting (given as entities) put back, e.g. to edit it with
+// telegram.ModeHTML. Nested entities aren't supported.
+func MessageHTML(text string, entities []telegram.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	var builder strings.Builder
+	offset := 0
+
+	for _, entity := range entities {
+		if entity.Offset < offset || entity.Offset+entity.Length > len(units) {
+			continue
+		}
+
+		var open, close string
+		switch entity.Type {
+		case telegram.EntityTMention:
+			if entity.User == nil {
+				continue
+			}
+			open, close = fmt.Sprintf(`<a href="tg://user?id=%v">`, entity.User.ID), "</a>"
+		case telegram.EntityTextLink:
+			open, close = fmt.Sprintf(`<a href="%v">`, html.EscapeString(entity.URL)), "</a>"
+		case telegram.EntityBold:
+			open, close = "<b>", "</b>"
+		case telegram.EntityItalic:
+			open, close = "<i>", "</i>"
+		case telegram.EntityCode:
+			open, close = "<code>", "</code>"
+		default:
+			continue
+		}
+
+		end := entity.Offset + entity.Length
+		builder.WriteString(html.EscapeString(string(utf16.Decode(units[offset:entity.Offset]))))
+		builder.WriteString(open)
+		builder.WriteString(html.EscapeString(string(utf16.Decode(units[entity.Offset:end]))))
+		builder.WriteString(close)
+		offset = end
+	}
+
+	builder.WriteString(html.EscapeString(string(utf16.Decode(units[offset:]))))
+	return builder.String()
+}
+
+// JoinList joins items into an English list (e.g. "a, b and c").
+func JoinList(items []string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+// ParseDuration parses a duration like time.ParseDuration, but also
+// accepts days (e.g. "2d" or "1d12h").
+func ParseDuration(duration string) (time.Duration, error) {
+	days := 0
+	if index := strings.Index(duration, "d"); index != -1 {
+		var err error
+		days, err = strconv.Atoi(duration[:index])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", duration)
+		}
+
+		duration = duration[index+1:]
+		if duration == "" {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(days)*24*time.Hour + parsed, nil
+}
+
+// channelNamePattern matches valid public Telegram channel usernames.
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{4,31}$`)
+
+// ParseChannelURL returns the username of a public channel given as a
+// t.me link (to the channel, or to one of its posts) or @username. Returns
+// an error if the URL is malformed or points to a private invite link.
+func ParseChannelURL(channelURL string) (string, error) {
+	name := strings.TrimSpace(channelURL)
+	for _, prefix := range []string{"https://", "http://", "www.", "t.me/", "telegram.me/", "@"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	name = strings.TrimSuffix(name, "/")
+
+	// Links to a post end with its number, e.g. t.me/<channel>/42
+	if slash := strings.LastIndex(name, "/"); slash > 0 {
+		if _, err := strconv.Atoi(name[slash+1:]); err == nil {
+			name = name[:slash]
+		}
+	}
+
+	if strings.HasPrefix(name, "joinchat/") || strings.HasPrefix(name, "+") {
+		return "", fmt.Errorf("private invite links can't be resolved, please use a public channel")
+	}
+	if !channelNamePattern.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid channel name", name)
+	}
+
+	return name, nil
+}
+
+// ExtractPassphrase returns the rest of the first line of text containing the
+// marker (compared case-insensitively), without surrounding quotes.
+// Returns false if no line contains the marker.
+func ExtractPassphrase(text string, marker string) (string, bool) {
+	markerPattern := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(marker))
+
+	for _, line := range strings.Split(text, "\n") {
+		location := markerPattern.FindStringIndex(line)
+		if location == nil {
+			continue
+		}
+
+		passphrase := strings.Trim(strings.TrimSpace(line[location[1]:]), "\"'`“”")
+		if passphrase != "" {
+			return passphrase, true
+		}
+	}
+
+	return "", false
+}
+
+// urlPattern matches links, including bare domains and t.me handles.
+var urlPattern = regexp.MustCompile(
+	`(?i)(https?://|www\.|t\.me/|telegram\.me/|\b[a-z0-9-]+\.(com|net|org|io|xyz|me|ru|cc|ly|gg|top|site|online|club|info|biz|link|shop|app)\b)`,
+)
+
+// ContainsURL returns true if the text contains something that looks like a link.
+func ContainsURL(text string) bool {
+	return urlPattern.MatchString(text)
+}
+
+// ContainsAnyWord returns true if the text contains any of the given
+// (lowercase) words as a whole word (so "profit" isn't found in "profitable"),
+// compared once folded with FoldConfusables.
+func ContainsAnyWord(text string, words []string) bool {
+	for _, textWord := range strings.Fields(FoldConfusables(text)) {
+		for _, word := range words {
+			if textWord == word {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// HasBidiControls returns true if the text contains invisible characters
+// that change the direction text is displayed in (e.g. a right-to-left
+// override), which are used to disguise names.
+func HasBidiControls(text string) bool {
+	for _, r := range text {
+		if (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069') ||
+			r == '\u200e' || r == '\u200f' || r == '\u061c' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CountEmoji returns the number of emoji (and other pictographic symbols) in the text.
+func CountEmoji(text string) int {
+	count := 0
+
+	for _, r := range text {
+		if unicode.Is(unicode.So, r) || (r >= 0x1f000 && r <= 0x1faff) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// confusables maps characters that look like (or are commonly used in place
+// of) a Latin letter to that letter.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ո': 'n',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Accented Latin
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'ñ': 'n', 'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y', 'ı': 'i', 'ł': 'l',
+	// Digits and symbols
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'@': 'a', '$': 's', '|': 'l', '!': 'i',
+}
+
+// confusableSequences are letter sequences that look like another letter.
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w")
+
+// FoldConfusables returns the text in lowercase, with characters that look
+// like Latin letters (e.g. Cyrillic "а", fullwidth "Ａ" or "0") replaced by
+// them, and invisible characters removed. Words are separated by single spaces.
+func FoldConfusables(text string) string {
+	var folded strings.Builder
+	separated := true
+
+	for _, r := range strings.ToLower(text) {
+		if r >= 'ａ' && r <= 'ｚ' {
+			// Fullwidth letters
+			r = r - 'ａ' + 'a'
+		}
+		if replacement, ok := confusables[r]; ok {
+			r = replacement
+		}
+
+		switch {
+		case unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Mn, r):
+			// Invisible characters and combining marks (e.g. accents)
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			folded.WriteRune(r)
+			separated = false
+		case !separated:
+			folded.WriteRune(' ')
+			separated = true
+		}
+	}
+
+	return confusableSequences.Replace(strings.TrimSpace(folded.String()))
+}
+
+// EditDistance returns the number of characters that need to be inserted,
+// removed or replaced to turn one string into the other.
+func EditDistance(a string, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
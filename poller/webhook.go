@@ -0,0 +1,157 @@
+package poller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+// Webhook is a telegram.Poller that has Telegram push updates to us
+// instead of long polling for them. Only requests made to the secret
+// path are accepted, so several bots can share one reverse proxy.
+type Webhook struct {
+	// Listen is the local address to listen on (e.g. ":8443"). If empty,
+	// no listener is opened and the Webhook should be mounted on an
+	// existing http.Server instead (it is an http.Handler).
+	Listen string
+
+	// PublicURL is the URL Telegram should deliver updates to, not
+	// including the secret path (e.g. "https://example.com/bigboofer").
+	PublicURL string
+
+	// TLSCert and TLSKey are paths to the certificate and key to serve
+	// with. If either is empty, the listener uses plain HTTP (e.g. when
+	// TLS is terminated by a reverse proxy). The certificate is also
+	// uploaded to Telegram, so self-signed certificates work.
+	TLSCert string
+	TLSKey  string
+
+	// Secret is appended to PublicURL as the last path component.
+	// Requests to any other path are rejected.
+	Secret string
+
+	mutex sync.RWMutex
+	dest  chan<- telegram.Update
+}
+
+// NewWebhook returns a Webhook poller with the given settings.
+func NewWebhook(listen, publicURL, tlsCert, tlsKey, secret string) *Webhook {
+	return &Webhook{
+		Listen:    listen,
+		PublicURL: publicURL,
+		TLSCert:   tlsCert,
+		TLSKey:    tlsKey,
+		Secret:    secret,
+	}
+}
+
+// URL returns the full URL (including the secret path) that Telegram
+// will deliver updates to.
+func (webhook *Webhook) URL() string {
+	publicURL := webhook.PublicURL
+
+	if publicURL == "" {
+		// Nothing in front of us, so Telegram has to reach us directly
+		publicURL = "https://" + webhook.Listen
+	}
+
+	return strings.TrimSuffix(publicURL, "/") + "/" + webhook.Secret
+}
+
+// Poll registers the webhook with Telegram and starts the listener
+// (if any), forwarding received updates until told to stop.
+func (webhook *Webhook) Poll(bot *telegram.Bot, dest chan telegram.Update, stop chan struct{}) {
+	webhook.mutex.Lock()
+	webhook.dest = dest
+	webhook.mutex.Unlock()
+
+	var server *http.Server
+	if webhook.Listen != "" {
+		server = &http.Server{
+			Addr:    webhook.Listen,
+			Handler: webhook,
+		}
+
+		go func() {
+			var err error
+			if webhook.TLSCert != "" && webhook.TLSKey != "" {
+				err = server.ListenAndServeTLS(webhook.TLSCert, webhook.TLSKey)
+			} else {
+				err = server.ListenAndServe()
+			}
+
+			if err != http.ErrServerClosed {
+				log.Printf("Webhook listener on %v stopped!! %v\n", webhook.Listen, err)
+			}
+		}()
+	}
+
+	// We serve requests ourselves, so the telebot webhook is only used
+	// to register our URL with Telegram. It blocks until we are stopped
+	// (or registration fails).
+	registration := &telegram.Webhook{
+		Endpoint: &telegram.WebhookEndpoint{
+			PublicURL: webhook.URL(),
+			Cert:      webhook.TLSCert,
+		},
+	}
+	registration.Poll(bot, dest, stop)
+
+	if server != nil {
+		server.Shutdown(context.Background())
+	}
+}
+
+// ServeHTTP reads an update from the body of a request made to the
+// secret path and hands it to the bot.
+func (webhook *Webhook) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost || !webhook.hasSecret(request.URL.Path) {
+		log.Printf(
+			"Rejected webhook request from %v to %v\n",
+			request.RemoteAddr, request.URL.Path,
+		)
+		http.NotFound(writer, request)
+		return
+	}
+
+	var update telegram.Update
+	err := json.NewDecoder(request.Body).Decode(&update)
+
+	if err != nil {
+		log.Printf("Could not decode webhook update!! %v\n", err)
+		http.Error(writer, "bad update", http.StatusBadRequest)
+		return
+	}
+
+	webhook.mutex.RLock()
+	dest := webhook.dest
+	webhook.mutex.RUnlock()
+
+	if dest == nil {
+		// Not polling yet, Telegram will retry later
+		http.Error(writer, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	dest <- update
+}
+
+// hasSecret returns true if the last component of the request path
+// matches the configured secret. (The reverse proxy may add or strip
+// its own prefix, so the rest of the path is not checked.)
+func (webhook *Webhook) hasSecret(path string) bool {
+	if webhook.Secret == "" {
+		return true
+	}
+
+	lastComponent := path[strings.LastIndex(path, "/")+1:]
+	return subtle.ConstantTimeCompare(
+		[]byte(lastComponent), []byte(webhook.Secret),
+	) == 1
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bigboofer/blocklist"
 	"bigboofer/database"
 	"bigboofer/handlers"
+	"bigboofer/poller"
 
 	"log"
+	"os"
 	"time"
 
 	telegram "gopkg.in/tucnak/telebot.v2"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	log.Println("Connecting to Telegram...")
 
 	// Connect bot to Telegram
@@ -18,6 +25,7 @@ func main() {
 
 	// Set up database
 	database.OnboardDB()
+	handlers.BlocklistMaintainers = BlocklistMaintainers
 
 	// Register event handlers
 	bot.Handle(telegram.OnAddedToGroup, func(message *telegram.Message) {
@@ -26,12 +34,120 @@ func main() {
 	bot.Handle(telegram.OnUserJoined, func(message *telegram.Message) {
 		handlers.OnUserJoined(bot, message)
 	})
+	bot.Handle(telegram.OnUserLeft, func(message *telegram.Message) {
+		handlers.OnUserLeft(bot, message)
+	})
+	bot.Handle("/start", func(message *telegram.Message) {
+		handlers.OnStartCommand(bot, message)
+	})
 	bot.Handle("/setchannel", func(message *telegram.Message) {
 		handlers.OnSetChannelCommand(bot, message)
 	})
 	bot.Handle("/approve", func(message *telegram.Message) {
 		handlers.OnApproveCommand(bot, message)
 	})
+	bot.Handle("/reject", func(message *telegram.Message) {
+		handlers.OnRejectCommand(bot, message)
+	})
+	bot.Handle("/extend", func(message *telegram.Message) {
+		handlers.OnExtendCommand(bot, message)
+	})
+	bot.Handle("/ban", func(message *telegram.Message) {
+		handlers.OnBanCommand(bot, message)
+	})
+	bot.Handle("/block", func(message *telegram.Message) {
+		handlers.OnBlockCommand(bot, message)
+	})
+	bot.Handle("/unban", func(message *telegram.Message) {
+		handlers.OnUnbanCommand(bot, message)
+	})
+	bot.Handle("/kick", func(message *telegram.Message) {
+		handlers.OnKickCommand(bot, message)
+	})
+	bot.Handle("/mute", func(message *telegram.Message) {
+		handlers.OnMuteCommand(bot, message)
+	})
+	bot.Handle("/unmute", func(message *telegram.Message) {
+		handlers.OnUnmuteCommand(bot, message)
+	})
+	bot.Handle("/modlog", func(message *telegram.Message) {
+		handlers.OnModLogCommand(bot, message)
+	})
+	bot.Handle("/unblock", func(message *telegram.Message) {
+		handlers.OnUnblockCommand(bot, message)
+	})
+	bot.Handle("/fed", func(message *telegram.Message) {
+		handlers.OnFedCommand(bot, message)
+	})
+	bot.Handle("/allowbot", func(message *telegram.Message) {
+		handlers.OnAllowBotCommand(bot, message)
+	})
+	bot.Handle("/disallowbot", func(message *telegram.Message) {
+		handlers.OnDisallowBotCommand(bot, message)
+	})
+	bot.Handle("/lockdown", func(message *telegram.Message) {
+		handlers.OnLockdownCommand(bot, message)
+	})
+	bot.Handle("/config", func(message *telegram.Message) {
+		handlers.OnConfigCommand(bot, message)
+	})
+	bot.Handle("/member", func(message *telegram.Message) {
+		handlers.OnMemberCommand(bot, message)
+	})
+	bot.Handle("/warn", func(message *telegram.Message) {
+		handlers.OnWarnCommand(bot, message)
+	})
+	bot.Handle("/warns", func(message *telegram.Message) {
+		handlers.OnWarnsCommand(bot, message)
+	})
+	bot.Handle("/unwarn", func(message *telegram.Message) {
+		handlers.OnUnwarnCommand(bot, message)
+	})
+	bot.Handle("/filter", func(message *telegram.Message) {
+		handlers.OnFilterCommand(bot, message)
+	})
+	bot.Handle("/spam", func(message *telegram.Message) {
+		handlers.OnSpamCommand(bot, message)
+	})
+	bot.Handle("/ham", func(message *telegram.Message) {
+		handlers.OnHamCommand(bot, message)
+	})
+	bot.Handle("/spamstats", func(message *telegram.Message) {
+		handlers.OnSpamStatsCommand(bot, message)
+	})
+	bot.Handle("/risk", func(message *telegram.Message) {
+		handlers.OnRiskCommand(bot, message)
+	})
+	bot.Handle("/status", func(message *telegram.Message) {
+		handlers.OnStatusCommand(bot, message)
+	})
+	bot.Handle("/diagnose", func(message *telegram.Message) {
+		handlers.OnStatusCommand(bot, message)
+	})
+	bot.Handle("/pending", func(message *telegram.Message) {
+		handlers.OnPendingCommand(bot, message)
+	})
+	bot.Handle(&handlers.PendingApproveButton, func(callback *telegram.Callback) {
+		handlers.OnPendingApproveButton(bot, callback)
+	})
+	bot.Handle(&handlers.PendingKickButton, func(callback *telegram.Callback) {
+		handlers.OnPendingKickButton(bot, callback)
+	})
+	bot.Handle(&handlers.PendingPageButton, func(callback *telegram.Callback) {
+		handlers.OnPendingPageButton(bot, callback)
+	})
+	bot.Handle(&handlers.WelcomeApproveButton, func(callback *telegram.Callback) {
+		handlers.OnWelcomeApproveButton(bot, callback)
+	})
+	bot.Handle(&handlers.WelcomeKickButton, func(callback *telegram.Callback) {
+		handlers.OnWelcomeKickButton(bot, callback)
+	})
+	bot.Handle(telegram.OnChannelPost, func(message *telegram.Message) {
+		handlers.OnChannelPost(bot, message)
+	})
+	bot.Handle(telegram.OnEditedChannelPost, func(message *telegram.Message) {
+		handlers.OnChannelPost(bot, message)
+	})
 	bot.Handle(telegram.OnText, func(message *telegram.Message) {
 		handlers.OnMessage(bot, message)
 	})
@@ -67,14 +183,25 @@ func main() {
 	})
 
 	// Schedule recurring job to purge people who take too long to
-	// respond to the challenge
+	// respond to the challenge (and undo timed bans and mutes)
 	go func(bot *telegram.Bot) {
 		for true {
 			time.Sleep(30 * time.Second)
 			database.PurgeOldChallengesForAllChats(bot)
+			handlers.EndQuietLockdowns(bot)
+			handlers.UndoExpiredModeration(bot)
 		}
 	}(bot)
 
+	// Schedule recurring job to keep the global blocklist in sync
+	// with the files in BlocklistDir
+	go func(watcher *blocklist.Watcher) {
+		for true {
+			watcher.Reload()
+			time.Sleep(BlocklistReloadInterval)
+		}
+	}(blocklist.NewWatcher(BlocklistDir))
+
 	log.Printf("Bot %v is connected!\n", bot.Me.Username)
 	bot.Start()
 }
@@ -82,7 +209,7 @@ func main() {
 func connectBot() *telegram.Bot {
 	bot, err := telegram.NewBot(telegram.Settings{
 		Token:  APIKey,
-		Poller: &telegram.LongPoller{Timeout: 10 * time.Second},
+		Poller: newPoller(),
 	})
 
 	if err != nil {
@@ -94,3 +221,18 @@ func connectBot() *telegram.Bot {
 
 	return bot
 }
+
+// newPoller returns a webhook poller if WebhookListen is set in config.go,
+// or a long poller otherwise.
+func newPoller() telegram.Poller {
+	if WebhookListen == "" {
+		return &telegram.LongPoller{Timeout: 10 * time.Second}
+	}
+
+	log.Printf("Listening for webhook updates on %v\n", WebhookListen)
+	return poller.NewWebhook(
+		WebhookListen, WebhookPublicURL,
+		WebhookTLSCert, WebhookTLSKey,
+		WebhookSecret,
+	)
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"bigboofer/blocklist"
+	"bigboofer/database"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestCanParseBlocklistFiles(t *testing.T) {
+	for path, expected := range map[string][]database.BlocklistEntry{
+		"testdata/blocklist.txt":  {{UserID: 123}, {UserID: 456}},
+		"testdata/blocklist.csv":  {{UserID: 789, Reason: "crypto spam"}, {UserID: 1011}},
+		"testdata/blocklist.json": {{UserID: 1213, Reason: "phishing"}, {UserID: 1415}},
+	} {
+		actual, err := blocklist.ParseFile(path)
+		if err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v to parse as %v, got %v (%v)", path, expected, actual, err)
+		}
+	}
+}
+
+func TestCanImportBlocklist(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1019}
+	imported := &telegram.User{ID: 789}
+	blocked := &telegram.User{ID: 52}
+	admin := &telegram.User{ID: 53}
+
+	if _, err := blocklist.Import("testdata/blocklist.csv"); err != nil {
+		t.Fatalf("Could not import blocklist: %v", err)
+	}
+	if reason, ok := database.GetBlocklistReason(imported, group); !ok || reason != "crypto spam" {
+		t.Errorf("Expected imported user to be blocked for crypto spam, got %v (%v)", reason, ok)
+	}
+
+	database.BlockUser(group, blocked, "flooding", admin)
+	if _, ok := database.GetBlocklistReason(blocked, group); !ok {
+		t.Errorf("Expected user to be blocked in the group")
+	}
+	if _, ok := database.GetBlocklistReason(blocked, &telegram.Chat{ID: group.ID - 1}); ok {
+		t.Errorf("Expected user not to be blocked in other groups")
+	}
+
+	if !database.UnblockUser(group, blocked, admin) {
+		t.Errorf("Expected user to be unblocked")
+	}
+	if _, ok := database.GetBlocklistReason(blocked, group); ok {
+		t.Errorf("Expected user to no longer be blocked")
+	}
+}
+
+func TestGlobalUnblockSurvivesReimport(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1022}
+	imported := &telegram.User{ID: 789}
+	maintainer := &telegram.User{ID: 54}
+
+	blocklist.Import("testdata/blocklist.csv")
+	if !database.UnblockUser(nil, imported, maintainer) {
+		t.Fatalf("Expected imported user to be unblocked globally")
+	}
+
+	blocklist.Import("testdata/blocklist.csv")
+	if _, ok := database.GetBlocklistReason(imported, group); ok {
+		t.Errorf("Expected reimporting not to block the user again")
+	}
+}
+
+func TestWatcherDropsBlocklistsDeletedWhileStopped(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1025}
+	watched := &telegram.User{ID: 123}
+	imported := &telegram.User{ID: 789}
+
+	dir, err := ioutil.TempDir(testDBDir, "blocklists")
+	if err != nil {
+		t.Fatalf("Could not create blocklist directory: %v", err)
+	}
+	contents, _ := ioutil.ReadFile("testdata/blocklist.txt")
+	ioutil.WriteFile(filepath.Join(dir, "blocklist.txt"), contents, 0644)
+
+	blocklist.NewWatcher(dir).Reload()
+	blocklist.Import("testdata/blocklist.csv")
+	if _, ok := database.GetBlocklistReason(watched, group); !ok {
+		t.Fatalf("Expected user in a watched file to be blocked")
+	}
+
+	// As if deleted while the bot wasn't running
+	os.Remove(filepath.Join(dir, "blocklist.txt"))
+	blocklist.NewWatcher(dir).Reload()
+
+	if _, ok := database.GetBlocklistReason(watched, group); ok {
+		t.Errorf("Expected user in a deleted file to be unblocked")
+	}
+	if _, ok := database.GetBlocklistReason(imported, group); !ok {
+		t.Errorf("Expected user imported by hand to stay blocked")
+	}
+}
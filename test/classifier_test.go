@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bigboofer/classifier"
+	"bigboofer/database"
+
+	"testing"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := classifier.Tokenize("FREE free Вitcoin at cheapcoins.xyz, a b")
+
+	expected := []string{classifier.LinkToken, "free", "bitcoin", "at", "cheapcoins", "xyz"}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected tokens %v, got %v", expected, tokens)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Errorf("Expected tokens %v, got %v", expected, tokens)
+			break
+		}
+	}
+}
+
+func TestProbability(t *testing.T) {
+	documents := database.SpamCounts{Spam: 10, Ham: 10}
+	counts := map[string]database.SpamCounts{
+		"bitcoin": {Spam: 9, Ham: 0},
+		"free":    {Spam: 6, Ham: 2},
+		"hello":   {Spam: 1, Ham: 8},
+	}
+
+	if spam := classifier.Probability([]string{"free", "bitcoin"}, counts, documents); spam < 0.95 {
+		t.Errorf("Expected spam to be likely, got %v", spam)
+	}
+	if ham := classifier.Probability([]string{"hello", "everyone"}, counts, documents); ham > 0.2 {
+		t.Errorf("Expected ham to be unlikely spam, got %v", ham)
+	}
+	if unknown := classifier.Probability([]string{"everyone"}, counts, documents); unknown != 0.5 {
+		t.Errorf("Expected unknown words to say nothing, got %v", unknown)
+	}
+}
+
+func TestCanTrainSpamModel(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1020}
+
+	if !classifier.Train(group, 1, "free bitcoin", true) {
+		t.Fatalf("Expected a new message to be learned")
+	}
+	if classifier.Train(group, 1, "free bitcoin", true) {
+		t.Errorf("Expected the same message not to be learned twice")
+	}
+	classifier.Train(group, 2, "free lunch", true)
+
+	// An admin changed their mind
+	if !classifier.Train(group, 2, "free lunch", false) {
+		t.Errorf("Expected a message to be relearned the other way")
+	}
+
+	if counts := database.GetSpamTrainingCounts(group); counts.Spam != 1 || counts.Ham != 1 {
+		t.Errorf("Expected 1 spam and 1 ham message, got %+v", counts)
+	}
+
+	counts := database.GetSpamTokenCounts(group, []string{"free", "bitcoin", "lunch", "unseen"})
+	if counts["free"] != (database.SpamCounts{Spam: 1, Ham: 1}) ||
+		counts["lunch"] != (database.SpamCounts{Spam: 0, Ham: 1}) || len(counts) != 3 {
+		t.Errorf("Expected token counts to follow training, got %+v", counts)
+	}
+
+	if _, ready := classifier.SpamProbability(group, "free bitcoin"); ready {
+		t.Errorf("Expected the model not to be ready with so few messages")
+	}
+}
+
+func TestNewcomersMessagesAreSpamOnlyIfTheyFail(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1024}
+	spammer := &telegram.User{ID: 66, Username: "spammer"}
+	newbie := &telegram.User{ID: 67, Username: "newbie"}
+
+	database.AddUser(spammer, group)
+	database.AddUser(newbie, group)
+	database.HoldSpamEvidence(spammer, group, 1, classifier.Tokenize("free bitcoin"))
+	database.HoldSpamEvidence(newbie, group, 2, classifier.Tokenize("hi, how do I get verified?"))
+
+	if counts := database.GetSpamTrainingCounts(group); counts.Spam != 0 {
+		t.Errorf("Expected nothing to be learned before the challenges end, got %+v", counts)
+	}
+
+	database.VetUser(newbie, group, newbie)
+	database.FailUser(spammer, group, nil)
+	if counts := database.GetSpamTrainingCounts(group); counts.Spam != 1 || counts.Ham != 0 {
+		t.Errorf("Expected only the failed user's message to be learned as spam, got %+v", counts)
+	}
+}
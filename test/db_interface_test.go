@@ -4,15 +4,480 @@ import (
 	"bigboofer/database"
 
 	"testing"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
 )
 
 func TestCanOnboardNewDB(t *testing.T) {
-	database.OnboardDB()
+	useFreshDB(t)
 }
 
 func TestCanCreateNewDBConnection(t *testing.T) {
-	database.OnboardDB()
+	useFreshDB(t)
 	if database.GetDB() == nil {
 		t.Errorf("Returned nil database object")
 	}
 }
+
+func TestCanListChallengesForChat(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1001}
+	user := &telegram.User{ID: 42, Username: "newbie", FirstName: "New"}
+
+	database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	if count := database.CountChallengesForChat(group); count != 1 {
+		t.Fatalf("Expected 1 challenge, got %v", count)
+	}
+
+	challenges := database.GetChallengesForChat(group, 10, 0)
+	if len(challenges) != 1 || challenges[0].UserID != user.ID {
+		t.Fatalf("Expected challenge for %v, got %v", user.ID, challenges)
+	}
+	if !challenges[0].ExpiresOn.After(challenges[0].IssuedOn) {
+		t.Errorf("Expected challenge to expire after %v, got %v",
+			challenges[0].IssuedOn, challenges[0].ExpiresOn)
+	}
+	if challenges[0].DisplayName != "New" {
+		t.Errorf("Expected display name New, got %v", challenges[0].DisplayName)
+	}
+}
+
+func TestCanExtendChallenge(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1002}
+	user := &telegram.User{ID: 43, Username: "slowpoke"}
+
+	database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	before := database.GetChallengesForChat(group, 1, 0)[0]
+	database.ExtendChallenge(user, group, 10*time.Minute)
+	after := database.GetChallengesForChat(group, 1, 0)[0]
+
+	if after.ExpiresOn.Sub(before.ExpiresOn) != 10*time.Minute {
+		t.Errorf("Expected challenge to be extended by 10m, got %v", after.ExpiresOn.Sub(before.ExpiresOn))
+	}
+	if !after.IssuedOn.Equal(before.IssuedOn) {
+		t.Errorf("Expected join time to stay %v, got %v", before.IssuedOn, after.IssuedOn)
+	}
+}
+
+func TestCanFindChallengeByToken(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1003}
+	user := &telegram.User{ID: 44, Username: "shy"}
+
+	token := database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	groupID, userID := database.GetChallengeForToken(token)
+	if groupID != group.ID || userID != user.ID {
+		t.Errorf("Expected token to map to %v/%v, got %v/%v", group.ID, user.ID, groupID, userID)
+	}
+
+	if groupID, _ := database.GetChallengeForToken("nonsense"); groupID != 0 {
+		t.Errorf("Expected unknown token to map to nothing, got %v", groupID)
+	}
+}
+
+func TestRemindersAreThrottled(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1004}
+	user := &telegram.User{ID: 45, Username: "chatty"}
+
+	database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	if !database.MarkUserReminded(user, group, time.Minute) {
+		t.Errorf("Expected first reminder to be allowed")
+	}
+	if database.MarkUserReminded(user, group, time.Minute) {
+		t.Errorf("Expected second reminder to be throttled")
+	}
+	if !database.MarkUserReminded(user, group, 0) {
+		t.Errorf("Expected reminder to be allowed without an interval")
+	}
+}
+
+func TestLeavingEndsChallenge(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1005}
+	user := &telegram.User{ID: 46, Username: "dodger"}
+
+	first := database.AddUser(user, group)
+	database.AddDeparture(user, group)
+	database.FailUser(user, group, user)
+
+	if count := database.CountChallengesForChat(group); count != 0 {
+		t.Errorf("Expected no challenge after leaving, got %v", count)
+	}
+	if state := database.GetMemberState(user, group); state != database.MemberFailed {
+		t.Errorf("Expected %v after leaving, got %v", database.MemberFailed, state)
+	}
+
+	second := database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	if second == first {
+		t.Errorf("Expected rejoin to get a new challenge, got %v again", first)
+	}
+	if count := database.CountChallengesForChat(group); count != 1 {
+		t.Errorf("Expected 1 challenge after rejoin, got %v", count)
+	}
+	if departures := database.CountRecentDepartures(user, group); departures != 1 {
+		t.Errorf("Expected 1 departure after rejoin, got %v", departures)
+	}
+}
+
+func TestCanCountDepartures(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1006}
+	user := &telegram.User{ID: 47, Username: "leaver"}
+
+	before := database.CountRecentDepartures(user, group)
+	database.AddDeparture(user, group)
+	database.AddDeparture(user, group)
+
+	if after := database.CountRecentDepartures(user, group); after != before+2 {
+		t.Errorf("Expected %v departures, got %v", before+2, after)
+	}
+}
+
+func TestCanSetGroupSettings(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1007}
+
+	if value := database.GetGroupSetting(group, "unset", "default"); value != "default" {
+		t.Errorf("Expected default for unset setting, got %v", value)
+	}
+
+	database.SetGroupSetting(group, "trust_member_adds", "on")
+	database.SetGroupSetting(group, "trust_member_adds", "off")
+	if value := database.GetGroupSetting(group, "trust_member_adds", "on"); value != "off" {
+		t.Errorf("Expected off, got %v", value)
+	}
+}
+
+func TestCanAllowBots(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1008}
+
+	database.AllowBot(group, "GoodBot")
+	if !database.BotIsAllowed(group, "goodbot") {
+		t.Error("Expected goodbot to be allowed")
+	}
+
+	database.DisallowBot(group, "goodbot")
+	if database.BotIsAllowed(group, "GoodBot") {
+		t.Error("Expected GoodBot to no longer be allowed")
+	}
+}
+
+func TestMemberStateFollowsChallenge(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1009}
+	user := &telegram.User{ID: 48, Username: "stateful"}
+	admin := &telegram.User{ID: 49, Username: "admin"}
+
+	if state := database.GetMemberState(user, group); state != database.MemberUnknown {
+		t.Fatalf("Expected unknown member, got %v", state)
+	}
+
+	database.AddUser(user, group)
+	if state := database.GetMemberState(user, group); state != database.MemberPending {
+		t.Fatalf("Expected pending member, got %v", state)
+	}
+
+	database.VetUser(user, group, admin)
+	member := database.GetMember(user, group)
+	if member.State != database.MemberVerified || member.VerifiedBy != admin.ID || member.VerifiedOn.IsZero() {
+		t.Fatalf("Expected member verified by %v, got %+v", admin.ID, member)
+	}
+	if database.CountChallengesForChat(group) != 0 {
+		t.Errorf("Expected challenge to be cleared")
+	}
+	if userID := database.GetIDForMemberUsername(group, "Stateful"); userID != user.ID {
+		t.Errorf("Expected to find %v by username, got %v", user.ID, userID)
+	}
+
+	history := database.GetMemberHistory(user, group, 10)
+	if len(history) < 2 || history[0].State != database.MemberVerified {
+		t.Errorf("Expected history ending in verified, got %+v", history)
+	}
+}
+
+func TestCanShareVerifications(t *testing.T) {
+	useFreshDB(t)
+	sharing := &telegram.Chat{ID: -1011}
+	joining := &telegram.Chat{ID: sharing.ID - 1}
+	user := &telegram.User{ID: 50, Username: "traveller"}
+
+	database.AddUser(user, sharing)
+	database.VetUser(user, sharing, user)
+
+	if !database.UserVerifiedWithin(user, sharing, 24*time.Hour) {
+		t.Errorf("Expected user to be recently verified")
+	}
+	if database.UserVerifiedElsewhereWithin(user, joining, 0) {
+		t.Errorf("Expected verification not to be shared before opting in")
+	}
+
+	database.SetGroupSetting(sharing, database.ShareVerificationsSetting, "on")
+	if !database.UserVerifiedElsewhereWithin(user, joining, 24*time.Hour) {
+		t.Errorf("Expected verification to be shared after opting in")
+	}
+}
+
+func TestCanShareVerificationsInFederation(t *testing.T) {
+	useFreshDB(t)
+	owner := &telegram.Chat{ID: -1012}
+	joining := &telegram.Chat{ID: owner.ID - 1}
+	user := &telegram.User{ID: 51, Username: "federated"}
+
+	token := database.CreateFederation(owner, "friends")
+	if federation := database.JoinFederation(joining, token); federation == nil || federation.Name != "friends" {
+		t.Fatalf("Expected to join federation friends, got %+v", federation)
+	}
+	if groups := database.GetFederationGroups(database.GetFederation(owner)); len(groups) != 2 {
+		t.Fatalf("Expected 2 groups in federation, got %v", groups)
+	}
+
+	database.AddUser(user, owner)
+	database.VetUser(user, owner, user)
+	if database.UserVerifiedInFederationWithin(user, joining, 0) {
+		t.Errorf("Expected verification not to be shared before enabling it")
+	}
+
+	database.SetFederationSharesVerifications(database.GetFederation(owner), true)
+	if !database.UserVerifiedInFederationWithin(user, joining, 24*time.Hour) {
+		t.Errorf("Expected verification to be shared after enabling it")
+	}
+
+	database.LeaveFederation(joining)
+	if database.GetFederation(joining) != nil {
+		t.Errorf("Expected group to have left the federation")
+	}
+}
+
+func TestCanMakeChallengeStrict(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1010}
+	user := &telegram.User{ID: 54, Username: "raider"}
+
+	if timeout := database.ChallengeTimeout(); timeout != 5*time.Minute {
+		t.Fatalf("Expected a 5 minute challenge timeout, got %v", timeout)
+	}
+
+	database.AddUser(user, group)
+	defer database.VetUser(user, group, nil)
+
+	database.MakeChallengeStrict(user, group, 2*time.Minute)
+	database.MakeChallengeStrict(user, group, 2*time.Minute)
+	if !database.ChallengeIsStrict(user, group) {
+		t.Errorf("Expected challenge to be strict")
+	}
+
+	challenge := database.GetChallengesForChat(group, 1, 0)[0]
+	if timeLeft := challenge.ExpiresOn.Sub(time.Now().UTC()); timeLeft > 2*time.Minute || timeLeft < time.Minute {
+		t.Errorf("Expected about 2 minutes left, got %v", timeLeft)
+	}
+}
+
+func TestCanRecordRiskScores(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1013}
+	user := &telegram.User{ID: 55, Username: "cryptoking"}
+
+	if _, scored := database.GetRiskScore(user, group); scored {
+		t.Fatalf("Expected no risk score yet")
+	}
+
+	database.RecordRiskScore(user, group, 20, nil, database.RiskChallenged)
+	database.RecordRiskScore(user, group, 90, []string{"name_has_link", "name_has_crypto_words"}, database.RiskBanned)
+
+	risk, scored := database.GetRiskScore(user, group)
+	if !scored || risk.Score != 90 || risk.Outcome != database.RiskBanned || len(risk.Signals) != 2 {
+		t.Errorf("Expected the latest risk score to be recorded, got %+v", risk)
+	}
+
+	if scores := database.GetRiskScores(group, 10); len(scores) != 2 || scores[1].Signals != nil {
+		t.Errorf("Expected 2 risk scores, the oldest without signals, got %+v", scores)
+	}
+}
+
+func TestCanQuarantineMembers(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1014}
+	user := &telegram.User{ID: 56, Username: "boofer", FirstName: "Big"}
+
+	if database.UpdateMemberName(user, group) {
+		t.Errorf("Expected no name change for a user never seen joining")
+	}
+
+	database.AddUser(user, group)
+	if database.UpdateMemberName(user, group) {
+		t.Errorf("Expected no name change right after joining")
+	}
+
+	user.FirstName = "Group Admin"
+	if !database.UpdateMemberName(user, group) {
+		t.Errorf("Expected a name change to be noticed")
+	}
+	if database.UpdateMemberName(user, group) {
+		t.Errorf("Expected the new name to be recorded")
+	}
+
+	database.QuarantineUser(user, group, nil)
+	if state := database.GetMemberState(user, group); state != database.MemberQuarantined {
+		t.Errorf("Expected user to be quarantined, got %v", state)
+	}
+	if count := database.CountChallengesForChat(group); count != 0 {
+		t.Errorf("Expected quarantine to end the challenge, got %v challenges", count)
+	}
+}
+
+func TestReleasingKeepsOriginalVerification(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1026}
+	member := &telegram.User{ID: 84, Username: "regular"}
+	newcomer := &telegram.User{ID: 85, Username: "stranger"}
+	admin := &telegram.User{ID: 86}
+
+	database.AddUser(member, group)
+	database.VetUser(member, group, member)
+	database.QuarantineUser(member, group, nil)
+	database.ReleaseUser(member, group, admin)
+
+	if released := database.GetMember(member, group); released.State != database.MemberVerified || released.VerifiedBy != member.ID {
+		t.Errorf("Expected member to be verified by themselves again, got %v by %v", released.State, released.VerifiedBy)
+	}
+
+	database.QuarantineUser(newcomer, group, nil)
+	database.ReleaseUser(newcomer, group, admin)
+
+	if released := database.GetMember(newcomer, group); released.State != database.MemberVerified || released.VerifiedBy != admin.ID {
+		t.Errorf("Expected newcomer to be verified by the admin, got %v by %v", released.State, released.VerifiedBy)
+	}
+}
+
+func TestProbationMessagesAreLimited(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1015}
+	user := &telegram.User{ID: 57, Username: "newbie"}
+
+	database.AddUser(user, group)
+	database.VetUser(user, group, user)
+
+	database.LogProbationMessage(user, group, 1, "hi all", "", 2)
+	database.LogProbationMessage(user, group, 2, "buy now example.com", "links", 2)
+	database.LogProbationMessage(user, group, 3, "third", "", 2)
+
+	messages := database.GetProbationMessages(user, group)
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages to be kept, got %v", len(messages))
+	}
+	if messages[0].Content != "hi all" || messages[1].Blocked != "links" {
+		t.Errorf("Expected the first 2 messages in order, got %+v", messages)
+	}
+}
+
+func TestCanManageFilters(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1016}
+	admin := &telegram.User{ID: 58, Username: "boss"}
+
+	first := database.AddFilter(group, `free \w+coin`, "ban", admin)
+	second := database.AddFilter(group, "casino", "delete", admin)
+	if first == 0 || second == 0 {
+		t.Fatalf("Expected filters to be added, got IDs %v and %v", first, second)
+	}
+
+	if !database.RemoveFilter(group, first) {
+		t.Errorf("Expected filter #%v to be removed", first)
+	}
+	if database.RemoveFilter(group, first) {
+		t.Errorf("Expected filter #%v to be gone already", first)
+	}
+
+	filters := database.GetFilters(group)
+	if len(filters) != 1 || filters[0].ID != second || filters[0].Action != "delete" {
+		t.Errorf("Expected only filter #%v to remain, got %+v", second, filters)
+	}
+}
+
+func TestCanManageWarnings(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1017}
+	user := &telegram.User{ID: 59, Username: "rowdy"}
+	admin := &telegram.User{ID: 60, Username: "boss"}
+
+	database.AddWarning(user, group, "spamming", admin)
+	database.AddWarning(user, group, "matched filter #1", nil)
+	if count := database.CountWarningsWithin(user, group, time.Hour); count != 2 {
+		t.Errorf("Expected 2 recent warnings, got %v", count)
+	}
+
+	if !database.RemoveLatestWarning(user, group) {
+		t.Errorf("Expected the latest warning to be removed")
+	}
+
+	warnings := database.GetWarnings(user, group)
+	if len(warnings) != 1 || warnings[0].Reason != "spamming" {
+		t.Errorf("Expected only the first warning to remain, got %+v", warnings)
+	}
+
+	database.RemoveLatestWarning(user, group)
+	if database.RemoveLatestWarning(user, group) {
+		t.Errorf("Expected no warnings left to remove")
+	}
+}
+
+func TestModerationLogExpiresTimedActions(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1018}
+	muted := &telegram.User{ID: 61, Username: "loud"}
+	banned := &telegram.User{ID: 62, Username: "rude"}
+	admin := &telegram.User{ID: 63, Username: "boss"}
+
+	database.LogModerationAction(muted, group, database.ActionMute, "flooding", time.Second, admin)
+	database.LogModerationAction(banned, group, database.ActionBan, "insults", time.Second, admin)
+	database.LogModerationAction(banned, group, database.ActionUnban, "changed my mind", 0, admin)
+	time.Sleep(2 * time.Second)
+
+	var expired []database.ModerationLogEntry
+	for _, entry := range database.GetExpiredModerationActions() {
+		if entry.GroupID == group.ID {
+			expired = append(expired, entry)
+		}
+	}
+	if len(expired) != 1 || expired[0].UserID != muted.ID || expired[0].Action != database.ActionMute {
+		t.Errorf("Expected only the mute to have expired, got %+v", expired)
+	}
+
+	database.LogModerationAction(muted, group, database.ActionUnmute, "mute expired", 0, nil)
+	entries := database.GetModerationLog(group, 10)
+	if len(entries) != 4 || entries[0].Action != database.ActionUnmute || entries[3].Reason != "flooding" {
+		t.Errorf("Expected all 4 actions, latest first, got %+v", entries)
+	}
+	if entries[0].DoneBy != 0 || !entries[0].ExpiresOn.IsZero() || entries[3].ExpiresOn.IsZero() {
+		t.Errorf("Expected only the mute to expire, and the unmute to be done by me, got %+v", entries)
+	}
+}
+
+func TestKickedMembersAreNotFailed(t *testing.T) {
+	useFreshDB(t)
+	group := &telegram.Chat{ID: -1023}
+	user := &telegram.User{ID: 64, Username: "regular"}
+	admin := &telegram.User{ID: 65, Username: "boss"}
+
+	database.AddUser(user, group)
+	database.VetUser(user, group, user)
+	database.KickUser(user, group, admin)
+
+	if state := database.GetMemberState(user, group); state != database.MemberKicked {
+		t.Errorf("Expected kicked member to be %v, got %v", database.MemberKicked, state)
+	}
+}
@@ -5,6 +5,9 @@ import (
 
 	"strings"
 	"testing"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
 )
 
 func TestGetRelativeProjPath(t *testing.T) {
@@ -15,3 +18,151 @@ func TestGetRelativeProjPath(t *testing.T) {
 		t.Errorf("Expected actual %v to end with %v", actual, expected)
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	for input, expected := range map[string]time.Duration{
+		"90s":   90 * time.Second,
+		"10m":   10 * time.Minute,
+		"2d":    48 * time.Hour,
+		"1d12h": 36 * time.Hour,
+	} {
+		actual, err := helpers.ParseDuration(input)
+		if err != nil || actual != expected {
+			t.Errorf("Expected %v to parse as %v, got %v (%v)", input, expected, actual, err)
+		}
+	}
+
+	if _, err := helpers.ParseDuration("xd"); err == nil {
+		t.Errorf("Expected xd to fail to parse")
+	}
+}
+
+func TestParseChannelURL(t *testing.T) {
+	for _, input := range []string{
+		"boofer_rules", "@boofer_rules", "t.me/boofer_rules", "https://t.me/boofer_rules/",
+		"t.me/boofer_rules/42", "https://t.me/boofer_rules/42/",
+	} {
+		actual, err := helpers.ParseChannelURL(input)
+		if err != nil || actual != "boofer_rules" {
+			t.Errorf("Expected %v to parse as boofer_rules, got %v (%v)", input, actual, err)
+		}
+	}
+
+	for _, input := range []string{
+		"https://t.me/joinchat/AAAAAE", "t.me/+AAAAAE", "boo", "boof", "t.me/boof", "not a channel",
+		"t.me/boofer_rules/intro",
+	} {
+		if _, err := helpers.ParseChannelURL(input); err == nil {
+			t.Errorf("Expected %v to be rejected", input)
+		}
+	}
+}
+
+func TestExtractPassphrase(t *testing.T) {
+	text := "Welcome to the group!\nRule 1: be nice\npassphrase: \"big boof\"\nPassphrase: other"
+
+	actual, ok := helpers.ExtractPassphrase(text, "Passphrase:")
+	if !ok || actual != "big boof" {
+		t.Errorf("Expected passphrase big boof, got %v", actual)
+	}
+
+	if _, ok := helpers.ExtractPassphrase("No passphrase here", "Passphrase:"); ok {
+		t.Errorf("Expected no passphrase to be found")
+	}
+}
+
+func TestJoinList(t *testing.T) {
+	for expected, items := range map[string][]string{
+		"":           {},
+		"a":          {"a"},
+		"a and b":    {"a", "b"},
+		"a, b and c": {"a", "b", "c"},
+	} {
+		if actual := helpers.JoinList(items); actual != expected {
+			t.Errorf("Expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+func TestContainsURL(t *testing.T) {
+	for text, expected := range map[string]bool{
+		"Alice":                   false,
+		"Dr. Bob":                 false,
+		"Free money t.me/scam":    true,
+		"visit cheapcoins.xyz":    true,
+		"https://example.org now": true,
+	} {
+		if actual := helpers.ContainsURL(text); actual != expected {
+			t.Errorf("Expected ContainsURL(%q) to be %v", text, expected)
+		}
+	}
+}
+
+func TestContainsAnyWord(t *testing.T) {
+	words := []string{"crypto", "profit"}
+	for text, expected := range map[string]bool{
+		"Crypto King":         true,
+		"daily_profit":        true,
+		"Ｃｒｙｐｔｏ":              true,
+		"Profitable Investor": false,
+		"cryptography fan":    false,
+	} {
+		if actual := helpers.ContainsAnyWord(text, words); actual != expected {
+			t.Errorf("Expected ContainsAnyWord(%q) to be %v", text, expected)
+		}
+	}
+}
+
+func TestProfileStuffing(t *testing.T) {
+	if !helpers.HasBidiControls("Alice‮eciffo") {
+		t.Errorf("Expected a right-to-left override to be found")
+	}
+	if helpers.HasBidiControls("Alice") {
+		t.Errorf("Expected no direction controls in a plain name")
+	}
+
+	if actual := helpers.CountEmoji("💰🚀 Bob 🔥"); actual != 3 {
+		t.Errorf("Expected 3 emoji, got %v", actual)
+	}
+}
+
+func TestFoldConfusables(t *testing.T) {
+	for text, expected := range map[string]string{
+		"Alice":          "alice",
+		"Аdmіn Теаm":     "admin team",
+		"ＢＩＧ＿ｂｏｏｆ":       "big boof",
+		"b0ofer_SUPP0RT": "boofer support",
+		"Ma\u200brn":     "mam",
+	} {
+		if actual := helpers.FoldConfusables(text); actual != expected {
+			t.Errorf("Expected %q to fold to %q, got %q", text, expected, actual)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for expected, pair := range map[int][2]string{
+		0: {"boofer", "boofer"},
+		1: {"boofer", "bofer"},
+		2: {"boofer", "bouffer"},
+		6: {"", "boofer"},
+	} {
+		if actual := helpers.EditDistance(pair[0], pair[1]); actual != expected {
+			t.Errorf("Expected distance %v between %q and %q, got %v", expected, pair[0], pair[1], actual)
+		}
+	}
+}
+
+func TestMessageHTML(t *testing.T) {
+	// "Hello, " is 7 UTF-16 code units, and the emoji 2
+	text := "Hello, 🐶 @boofer! Read <this>"
+	entities := []telegram.MessageEntity{
+		{Type: telegram.EntityTMention, Offset: 10, Length: 7, User: &telegram.User{ID: 42}},
+		{Type: telegram.EntityBold, Offset: 19, Length: 4},
+	}
+
+	expected := `Hello, 🐶 <a href="tg://user?id=42">@boofer</a>! <b>Read</b> &lt;this&gt;`
+	if actual := helpers.MessageHTML(text, entities); actual != expected {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
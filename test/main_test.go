@@ -0,0 +1,33 @@
+package test
+
+import (
+	"bigboofer/database"
+
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDBDir holds the database of every test, and is removed once they're done.
+var testDBDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	testDBDir, err = ioutil.TempDir("", "bigboofer-test")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(testDBDir)
+	os.Exit(code)
+}
+
+// useFreshDB points the database at a new, empty file for the current test,
+// so tests don't see each other's data (or that of earlier runs).
+func useFreshDB(t *testing.T) {
+	database.DBFile = filepath.Join(testDBDir, t.Name()+".sqlite3")
+	database.OnboardDB()
+}
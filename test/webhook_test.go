@@ -0,0 +1,172 @@
+package test
+
+import (
+	"bigboofer/poller"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	telegram "gopkg.in/tucnak/telebot.v2"
+)
+
+const fakeUpdate = `{
+	"update_id": 1,
+	"message": {
+		"message_id": 2,
+		"date": 1571234567,
+		"from": {"id": 3, "username": "newbie"},
+		"chat": {"id": -4, "type": "supergroup", "title": "Test"},
+		"text": "%s"
+	}
+}`
+
+// newWebhookBot returns a bot using a webhook poller that talks to a fake
+// Telegram API, and a channel receiving the URL it registers once started.
+func newWebhookBot(t *testing.T, webhook *poller.Webhook) (*telegram.Bot, *httptest.Server, chan string) {
+	registered := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch {
+		case strings.HasSuffix(request.URL.Path, "/getMe"):
+			writer.Write([]byte(`{"ok": true, "result": {"id": 1, "is_bot": true, "username": "testbot"}}`))
+		case strings.HasSuffix(request.URL.Path, "/setWebhook"):
+			var params map[string]string
+			json.NewDecoder(request.Body).Decode(&params)
+			writer.Write([]byte(`{"ok": true}`))
+			registered <- params["url"]
+		default:
+			writer.Write([]byte(`{"ok": true, "result": {}}`))
+		}
+	}))
+
+	bot, err := telegram.NewBot(telegram.Settings{
+		URL:    api.URL,
+		Token:  "TOKEN",
+		Poller: webhook,
+	})
+
+	if err != nil {
+		api.Close()
+		t.Fatalf("Could not create bot: %v", err)
+	}
+
+	return bot, api, registered
+}
+
+// startWebhookBot starts the bot and returns the URL it registered.
+func startWebhookBot(t *testing.T, bot *telegram.Bot, registered chan string) string {
+	go bot.Start()
+
+	select {
+	case url := <-registered:
+		return url
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook was never registered")
+	}
+
+	return ""
+}
+
+func TestWebhookRegistersSecretURL(t *testing.T) {
+	webhook := poller.NewWebhook("", "https://example.com/boofer/", "", "", "s3cret")
+	bot, api, registered := newWebhookBot(t, webhook)
+	defer api.Close()
+
+	url := startWebhookBot(t, bot, registered)
+	defer bot.Stop()
+
+	expected := "https://example.com/boofer/s3cret"
+	if url != expected {
+		t.Errorf("Expected webhook URL %v, got %v", expected, url)
+	}
+}
+
+func TestWebhookDispatchesUpdatesToHandlers(t *testing.T) {
+	webhook := poller.NewWebhook("", "https://example.com/boofer", "", "", "s3cret")
+	bot, api, registered := newWebhookBot(t, webhook)
+	defer api.Close()
+
+	fired := make(chan string, 2)
+	bot.Handle(telegram.OnText, func(message *telegram.Message) {
+		fired <- message.Text
+	})
+	bot.Handle("/approve", func(message *telegram.Message) {
+		fired <- "approve " + message.Payload
+	})
+
+	startWebhookBot(t, bot, registered)
+	defer bot.Stop()
+
+	endpoint := httptest.NewServer(webhook)
+	defer endpoint.Close()
+
+	for text, expected := range map[string]string{
+		"woof":             "woof",
+		"/approve @newbie": "approve @newbie",
+	} {
+		response, err := http.Post(
+			endpoint.URL+"/boofer/s3cret", "application/json",
+			strings.NewReader(strings.Replace(fakeUpdate, "%s", text, 1)),
+		)
+
+		if err != nil {
+			t.Fatalf("Could not post update: %v", err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %v", response.StatusCode)
+		}
+
+		select {
+		case actual := <-fired:
+			if actual != expected {
+				t.Errorf("Expected handler to receive %v, got %v", expected, actual)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Handler never fired for %v", text)
+		}
+	}
+}
+
+func TestWebhookRejectsWrongSecret(t *testing.T) {
+	webhook := poller.NewWebhook("", "https://example.com/boofer", "", "", "s3cret")
+	bot, api, registered := newWebhookBot(t, webhook)
+	defer api.Close()
+
+	fired := make(chan string, 1)
+	bot.Handle(telegram.OnText, func(message *telegram.Message) {
+		fired <- message.Text
+	})
+
+	startWebhookBot(t, bot, registered)
+	defer bot.Stop()
+
+	endpoint := httptest.NewServer(webhook)
+	defer endpoint.Close()
+
+	response, err := http.Post(
+		endpoint.URL+"/boofer/wrong", "application/json",
+		strings.NewReader(strings.Replace(fakeUpdate, "%s", "woof", 1)),
+	)
+
+	if err != nil {
+		t.Fatalf("Could not post update: %v", err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %v (%s)", response.StatusCode, body)
+	}
+
+	select {
+	case text := <-fired:
+		t.Errorf("Handler fired for rejected update: %v", text)
+	case <-time.After(200 * time.Millisecond):
+	}
+}